@@ -8,7 +8,15 @@ import (
 	"github.com/syndtr/gocapability/capability"
 )
 
-func dropCapabilities(vmcaps vm.AppCapabilities) error {
+// capabilities contains the capability sets of the entrypoint.
+type capabilities struct {
+	pid  capability.Capabilities
+	sets map[capability.CapType][]capability.Cap
+}
+
+// newCapabilities converts the capability lists of the spec and loads the
+// capabilities of the current process.
+func newCapabilities(vmcaps vm.AppCapabilities) (*capabilities, error) {
 	// capMap stores all available capabilities.
 	capMap := make(map[string]capability.Cap)
 	for _, v := range capability.List() {
@@ -32,34 +40,58 @@ func dropCapabilities(vmcaps vm.AppCapabilities) error {
 		return caps, nil
 	}
 
-	minCaps := []string{"CAP_SETGID", "CAP_SETUID", "CAP_SYS_ADMIN"}
-
-	p, err := capability.NewPid2(0)
-	if err != nil {
-		return fmt.Errorf("capability.NewPid2(0) failed: %w", err)
-	}
-	err = p.Load()
-	if err != nil {
-		return fmt.Errorf("capabilies.Load() failed: %w", err)
-	}
-
-	p.Clear(capability.CAPS | capability.BOUNDS)
-
+	c := &capabilities{sets: make(map[capability.CapType][]capability.Cap)}
 	for capType, list := range map[capability.CapType][]string{
-		capability.EFFECTIVE:   minCaps,
-		capability.PERMITTED:   minCaps,
-		capability.BOUNDS:      vmcaps.Bounding,
+		capability.AMBIENT:     vmcaps.Ambient,
+		capability.BOUNDING:    vmcaps.Bounding,
+		capability.EFFECTIVE:   vmcaps.Effective,
 		capability.INHERITABLE: vmcaps.Inheritable,
+		capability.PERMITTED:   vmcaps.Permitted,
 	} {
 		caps, err := listToCap(list)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		p.Set(capType, caps...)
+		c.sets[capType] = caps
+	}
+
+	var err error
+	c.pid, err = capability.NewPid2(0)
+	if err != nil {
+		return nil, fmt.Errorf("capability.NewPid2(0) failed: %w", err)
+	}
+	if err := c.pid.Load(); err != nil {
+		return nil, fmt.Errorf("capabilies.Load() failed: %w", err)
+	}
+	return c, nil
+}
+
+// applyBounding drops all capabilities from the bounding set that are not
+// in the bounding set of the spec. This requires CAP_SETPCAP and must be
+// done before the user id is changed.
+func (c *capabilities) applyBounding() error {
+	c.pid.Clear(capability.BOUNDS)
+	c.pid.Set(capability.BOUNDS, c.sets[capability.BOUNDING]...)
+	if err := c.pid.Apply(capability.BOUNDS); err != nil {
+		return fmt.Errorf("capabilies.Apply(BOUNDS) failed: %w", err)
 	}
+	return nil
+}
 
-	if err := p.Apply(capability.CAPS | capability.BOUNDS); err != nil {
-		return fmt.Errorf("capabilies.Apply() failed: %w", err)
+// apply sets the effective, permitted, inheritable and ambient sets of the
+// spec. Ambient capabilities must be permitted and inheritable to be raised.
+func (c *capabilities) apply() error {
+	c.pid.Clear(capability.CAPS | capability.AMBS)
+	for _, capType := range []capability.CapType{
+		capability.AMBIENT,
+		capability.EFFECTIVE,
+		capability.INHERITABLE,
+		capability.PERMITTED,
+	} {
+		c.pid.Set(capType, c.sets[capType]...)
+	}
+	if err := c.pid.Apply(capability.CAPS | capability.AMBS); err != nil {
+		return fmt.Errorf("capabilies.Apply(CAPS|AMBS) failed: %w", err)
 	}
 	return nil
 }
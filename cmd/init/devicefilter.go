@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/gotoz/runq/pkg/vm"
+	"golang.org/x/sys/unix"
+)
+
+// cgroup v2 has no devices controller. Device rules are enforced by an eBPF
+// program of type BPF_PROG_TYPE_CGROUP_DEVICE attached to the cgroup.
+//
+// The program checks the rules in reverse order, the last matching rule
+// wins. A rule for all devices with all access types resets the default
+// action, like writing "a" to devices.allow or devices.deny of cgroup v1.
+
+// bpfInsn is a single eBPF instruction.
+type bpfInsn struct {
+	code uint8
+	dst  uint8
+	src  uint8
+	off  int16
+	imm  int32
+}
+
+// eBPF registers
+const (
+	r0 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+)
+
+// loadDeviceFilter loads the device filter for the given rules and attaches
+// it to the cgroup v2 directory dir. Nested cgroups may attach their own
+// filters, e.g. systemd inside the container.
+func loadDeviceFilter(dir string, rules []vm.DeviceRule) error {
+	prog, err := deviceFilter(rules)
+	if err != nil {
+		return err
+	}
+
+	license := []byte("Apache\x00")
+	logBuf := make([]byte, 64<<10)
+	load := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(prog) / 8),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	fd, _, e1 := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&load)), unsafe.Sizeof(load))
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(license)
+	if e1 != 0 {
+		return fmt.Errorf("load device filter failed: %v: %s", e1, cstring(logBuf))
+	}
+	defer unix.Close(int(fd))
+
+	cg, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(cg)
+
+	attach := struct {
+		targetFd    uint32
+		attachBpfFd uint32
+		attachType  uint32
+		attachFlags uint32
+	}{
+		targetFd:    uint32(cg),
+		attachBpfFd: uint32(fd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+		attachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, _, e1 := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attach)), unsafe.Sizeof(attach)); e1 != 0 {
+		return fmt.Errorf("attach device filter to %s failed: %v", dir, e1)
+	}
+	return nil
+}
+
+// deviceFilter returns the encoded eBPF program for the given rules.
+func deviceFilter(rules []vm.DeviceRule) ([]byte, error) {
+	var allow bool
+	var active []vm.DeviceRule
+	for _, r := range rules {
+		access, err := deviceAccess(r.Access)
+		if err != nil {
+			return nil, err
+		}
+		if r.Type == "a" && r.Major == -1 && r.Minor == -1 && access == accessAll {
+			allow = r.Allow
+			active = nil
+			continue
+		}
+		active = append(active, r)
+	}
+
+	// struct bpf_cgroup_dev_ctx {
+	//	u32 access_type; /* (access << 16) | type */
+	//	u32 major;
+	//	u32 minor;
+	// };
+	insns := []bpfInsn{
+		{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, dst: r2, src: r1, off: 0},
+		{code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, dst: r2, imm: 0xffff},
+		{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, dst: r3, src: r1, off: 0},
+		{code: unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K, dst: r3, imm: 16},
+		{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, dst: r4, src: r1, off: 4},
+		{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, dst: r5, src: r1, off: 8},
+	}
+	for i := len(active) - 1; i >= 0; i-- {
+		insns = append(insns, deviceRuleBlock(active[i])...)
+	}
+	insns = append(insns, exitInsns(allow)...)
+
+	buf := make([]byte, 0, len(insns)*8)
+	for _, i := range insns {
+		buf = append(buf, i.encode()...)
+	}
+	return buf, nil
+}
+
+// deviceRuleBlock returns the instructions of a single rule. Each check jumps
+// to the next block if it doesn't match.
+func deviceRuleBlock(r vm.DeviceRule) []bpfInsn {
+	access, _ := deviceAccess(r.Access)
+	var block []bpfInsn
+	switch r.Type {
+	case "b":
+		block = append(block, bpfInsn{code: unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K, dst: r2, imm: unix.BPF_DEVCG_DEV_BLOCK})
+	case "c":
+		block = append(block, bpfInsn{code: unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K, dst: r2, imm: unix.BPF_DEVCG_DEV_CHAR})
+	}
+	if access != accessAll {
+		// The requested access must be a subset of the rule.
+		block = append(block,
+			bpfInsn{code: unix.BPF_ALU | unix.BPF_MOV | unix.BPF_X, dst: r1, src: r3},
+			bpfInsn{code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, dst: r1, imm: access},
+			bpfInsn{code: unix.BPF_JMP | unix.BPF_JNE | unix.BPF_X, dst: r1, src: r3},
+		)
+	}
+	if r.Major != -1 {
+		block = append(block, bpfInsn{code: unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K, dst: r4, imm: int32(r.Major)})
+	}
+	if r.Minor != -1 {
+		block = append(block, bpfInsn{code: unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K, dst: r5, imm: int32(r.Minor)})
+	}
+	block = append(block, exitInsns(r.Allow)...)
+
+	for i := range block {
+		if block[i].code&0x07 == unix.BPF_JMP && block[i].code != unix.BPF_JMP|unix.BPF_EXIT {
+			block[i].off = int16(len(block) - i - 1)
+		}
+	}
+	return block
+}
+
+func exitInsns(allow bool) []bpfInsn {
+	var rc int32
+	if allow {
+		rc = 1
+	}
+	return []bpfInsn{
+		{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, dst: r0, imm: rc},
+		{code: unix.BPF_JMP | unix.BPF_EXIT},
+	}
+}
+
+const accessAll = unix.BPF_DEVCG_ACC_MKNOD | unix.BPF_DEVCG_ACC_READ | unix.BPF_DEVCG_ACC_WRITE
+
+// deviceAccess converts an access string like "rwm" into BPF_DEVCG_ACC flags.
+// An empty string means all access types.
+func deviceAccess(s string) (int32, error) {
+	if s == "" {
+		return accessAll, nil
+	}
+	var access int32
+	for _, c := range s {
+		switch c {
+		case 'm':
+			access |= unix.BPF_DEVCG_ACC_MKNOD
+		case 'r':
+			access |= unix.BPF_DEVCG_ACC_READ
+		case 'w':
+			access |= unix.BPF_DEVCG_ACC_WRITE
+		default:
+			return 0, fmt.Errorf("invalid device access %q", s)
+		}
+	}
+	return access, nil
+}
+
+// encode returns the instruction in the layout of struct bpf_insn. The
+// register nibbles are bitfields and follow the byte order of the machine.
+func (i bpfInsn) encode() []byte {
+	b := make([]byte, 8)
+	b[0] = i.code
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		b[1] = i.dst<<4 | i.src
+	} else {
+		b[1] = i.src<<4 | i.dst
+	}
+	binary.NativeEndian.PutUint16(b[2:], uint16(i.off))
+	binary.NativeEndian.PutUint32(b[4:], uint32(i.imm))
+	return b
+}
+
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
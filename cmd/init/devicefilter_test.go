@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/gotoz/runq/pkg/vm"
+	"golang.org/x/sys/unix"
+)
+
+var bigEndian = binary.NativeEndian.Uint16([]byte{0, 1}) == 1
+
+// decode is the inverse of bpfInsn.encode.
+func decode(t *testing.T, prog []byte) []bpfInsn {
+	t.Helper()
+	if len(prog)%8 != 0 {
+		t.Fatalf("program length %d is not a multiple of 8", len(prog))
+	}
+	var insns []bpfInsn
+	for b := prog; len(b) > 0; b = b[8:] {
+		i := bpfInsn{
+			code: b[0],
+			off:  int16(binary.NativeEndian.Uint16(b[2:])),
+			imm:  int32(binary.NativeEndian.Uint32(b[4:])),
+		}
+		if bigEndian {
+			i.dst, i.src = b[1]>>4, b[1]&0x0f
+		} else {
+			i.dst, i.src = b[1]&0x0f, b[1]>>4
+		}
+		insns = append(insns, i)
+	}
+	return insns
+}
+
+const (
+	jneK = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+	jneX = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_X
+	movX = unix.BPF_ALU | unix.BPF_MOV | unix.BPF_X
+	andK = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	ret  = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+	exit = unix.BPF_JMP | unix.BPF_EXIT
+)
+
+func TestDeviceRuleBlock(t *testing.T) {
+	tests := []struct {
+		name string
+		rule vm.DeviceRule
+		want []bpfInsn
+	}{
+		{
+			name: "char device all access",
+			rule: vm.DeviceRule{Allow: true, Type: "c", Major: 1, Minor: 3, Access: "rwm"},
+			want: []bpfInsn{
+				{code: jneK, dst: r2, off: 4, imm: unix.BPF_DEVCG_DEV_CHAR},
+				{code: jneK, dst: r4, off: 3, imm: 1},
+				{code: jneK, dst: r5, off: 2, imm: 3},
+				{code: ret, dst: r0, imm: 1},
+				{code: exit},
+			},
+		},
+		{
+			name: "block device any minor read",
+			rule: vm.DeviceRule{Allow: false, Type: "b", Major: 8, Minor: -1, Access: "r"},
+			want: []bpfInsn{
+				{code: jneK, dst: r2, off: 6, imm: unix.BPF_DEVCG_DEV_BLOCK},
+				{code: movX, dst: r1, src: r3},
+				{code: andK, dst: r1, imm: unix.BPF_DEVCG_ACC_READ},
+				{code: jneX, dst: r1, src: r3, off: 3},
+				{code: jneK, dst: r4, off: 2, imm: 8},
+				{code: ret, dst: r0, imm: 0},
+				{code: exit},
+			},
+		},
+		{
+			name: "all devices read write",
+			rule: vm.DeviceRule{Allow: true, Type: "a", Major: -1, Minor: -1, Access: "rw"},
+			want: []bpfInsn{
+				{code: movX, dst: r1, src: r3},
+				{code: andK, dst: r1, imm: unix.BPF_DEVCG_ACC_READ | unix.BPF_DEVCG_ACC_WRITE},
+				{code: jneX, dst: r1, src: r3, off: 2},
+				{code: ret, dst: r0, imm: 1},
+				{code: exit},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := deviceRuleBlock(tt.rule)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", got, tt.want)
+			}
+			// Every jump must land on the first instruction after the block.
+			for i, insn := range got {
+				if insn.code&0x07 == unix.BPF_JMP && insn.code != exit && i+1+int(insn.off) != len(got) {
+					t.Errorf("instruction %d jumps to %d, want %d", i, i+1+int(insn.off), len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestDeviceFilter(t *testing.T) {
+	denyAll := vm.DeviceRule{Allow: false, Type: "a", Major: -1, Minor: -1, Access: "rwm"}
+	allowAll := vm.DeviceRule{Allow: true, Type: "a", Major: -1, Minor: -1, Access: ""}
+	null := vm.DeviceRule{Allow: true, Type: "c", Major: 1, Minor: 3, Access: "rwm"}
+	zero := vm.DeviceRule{Allow: true, Type: "c", Major: 1, Minor: 5, Access: "rw"}
+	tests := []struct {
+		name   string
+		rules  []vm.DeviceRule
+		allow  bool            // default action
+		active []vm.DeviceRule // in the order of the program
+	}{
+		{"no rules", nil, false, nil},
+		{"deny all", []vm.DeviceRule{denyAll, null, zero}, false, []vm.DeviceRule{zero, null}},
+		{"reset by allow all", []vm.DeviceRule{denyAll, null, allowAll, zero}, true, []vm.DeviceRule{zero}},
+		{"reset by deny all", []vm.DeviceRule{allowAll, null, denyAll}, false, nil},
+	}
+	const header = 6
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := deviceFilter(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := decode(t, prog)
+			var want []bpfInsn
+			for _, r := range tt.active {
+				want = append(want, deviceRuleBlock(r)...)
+			}
+			want = append(want, exitInsns(tt.allow)...)
+			if len(got) < header || !reflect.DeepEqual(got[header:], want) {
+				t.Errorf("got\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+
+	if _, err := deviceFilter([]vm.DeviceRule{{Type: "c", Major: 1, Minor: 3, Access: "rwx"}}); err == nil {
+		t.Error("invalid access accepted")
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		insn   bpfInsn
+		little []byte
+		big    []byte
+	}{
+		{
+			insn:   bpfInsn{code: jneX, dst: r1, src: r3, off: 2, imm: 0},
+			little: []byte{jneX, 0x31, 2, 0, 0, 0, 0, 0},
+			big:    []byte{jneX, 0x13, 0, 2, 0, 0, 0, 0},
+		},
+		{
+			insn:   bpfInsn{code: jneK, dst: r5, off: -1, imm: 0x12345678},
+			little: []byte{jneK, 0x05, 0xff, 0xff, 0x78, 0x56, 0x34, 0x12},
+			big:    []byte{jneK, 0x50, 0xff, 0xff, 0x12, 0x34, 0x56, 0x78},
+		},
+	}
+	for _, tt := range tests {
+		want := tt.little
+		if bigEndian {
+			want = tt.big
+		}
+		if got := tt.insn.encode(); !bytes.Equal(got, want) {
+			t.Errorf("%+v: got % x, want % x", tt.insn, got, want)
+		}
+	}
+}
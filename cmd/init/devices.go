@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/gotoz/runq/pkg/vm"
+	"github.com/pmorjan/kmod"
+	"golang.org/x/sys/unix"
+)
+
+// setupDevices loads the kernel modules of the character devices of the
+// entrypoint. The device numbers of the host are replaced by the numbers the
+// guest kernel assigned to the devices, in the devices and in the device
+// rules of the spec. Devices that the guest kernel doesn't provide are an
+// error.
+func setupDevices(devices []vm.Device, rules []vm.DeviceRule) ([]vm.DeviceRule, error) {
+	k, err := kmod.New()
+	if err != nil {
+		log.Printf("devices: %v", err)
+	}
+
+	type devnum struct{ major, minor int64 }
+	remap := make(map[devnum]devnum)
+	for i := range devices {
+		d := &devices[i]
+		if k != nil {
+			if err := loadDeviceModule(k, *d); err != nil {
+				log.Printf("devices: %s: %v", d.Path, err)
+			}
+		}
+
+		// Nodes are created by the kernel in devtmpfs.
+		var st unix.Stat_t
+		if err := unix.Stat(d.Path, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFCHR {
+			// The container may use another name, e.g. --device /dev/a:/dev/b.
+			if _, err := os.Stat(fmt.Sprintf("/sys/dev/char/%d:%d", d.Major, d.Minor)); err == nil {
+				continue
+			}
+			return nil, fmt.Errorf("device %s is not available in the VM", d.Path)
+		}
+		major := int64(unix.Major(uint64(st.Rdev)))
+		minor := int64(unix.Minor(uint64(st.Rdev)))
+		if major == d.Major && minor == d.Minor {
+			continue
+		}
+		remap[devnum{d.Major, d.Minor}] = devnum{major, minor}
+		d.Major, d.Minor = major, minor
+	}
+
+	// All rules are rewritten at once, devices may swap their numbers.
+	for i, r := range rules {
+		if n, ok := remap[devnum{r.Major, r.Minor}]; ok && r.Type == "c" {
+			rules[i].Major, rules[i].Minor = n.major, n.minor
+		}
+	}
+	return rules, nil
+}
+
+// loadDeviceModule loads the kernel module that provides a character device.
+// Modules are looked up by the aliases of the device numbers and the device
+// name. Built-in drivers are not an error.
+func loadDeviceModule(k *kmod.Kmod, d vm.Device) error {
+	name := strings.TrimPrefix(d.Path, "/dev/")
+	aliases := []string{
+		fmt.Sprintf("char-major-%d-%d", d.Major, d.Minor),
+		fmt.Sprintf("char-major-%d", d.Major),
+		"devname:" + name,
+	}
+	err := kmod.ErrModuleNotFound
+	for _, a := range aliases {
+		if err = k.Load(a, "", 0); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if _, e := os.Stat(d.Path); e == nil {
+			return nil
+		}
+		return err
+	}
+
+	// The kvm module creates /dev/kvm only together with the vendor module.
+	if name == "kvm" && runtime.GOARCH == "amd64" {
+		for _, m := range []string{"kvm_intel", "kvm_amd"} {
+			if err = k.Load(m, "", 0); err == nil {
+				break
+			}
+		}
+	}
+	return err
+}
+
+// createDevices creates the nodes of the character devices in /dev of the
+// entrypoint. Owner ids are mapped to the ids outside of the user namespace.
+func createDevices(devices []vm.Device, uidMappings, gidMappings []vm.IDMap) error {
+	for _, d := range devices {
+		dev := unix.Mkdev(uint32(d.Major), uint32(d.Minor))
+		var st unix.Stat_t
+		err := unix.Stat(d.Path, &st)
+		if err == nil && (st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != dev) {
+			// The path belongs to another device of the guest, e.g. --device /dev/a:/dev/b.
+			if err := os.Remove(d.Path); err != nil {
+				return fmt.Errorf("os.Remove %s failed: %w", d.Path, err)
+			}
+			err = os.ErrNotExist
+		}
+		if err != nil {
+			if err := os.MkdirAll(filepath.Dir(d.Path), 0755); err != nil {
+				return fmt.Errorf("os.MkdirAll %s failed: %w", d.Path, err)
+			}
+			if err := unix.Mknod(d.Path, unix.S_IFCHR|d.FileMode, int(dev)); err != nil {
+				return fmt.Errorf("unix.Mknod %s failed: %w", d.Path, err)
+			}
+		}
+		if err := os.Chmod(d.Path, os.FileMode(d.FileMode)); err != nil {
+			return fmt.Errorf("os.Chmod %s failed: %w", d.Path, err)
+		}
+		uid := hostID(d.UID, uidMappings)
+		gid := hostID(d.GID, gidMappings)
+		if err := os.Chown(d.Path, uid, gid); err != nil {
+			return fmt.Errorf("os.Chown %s failed: %w", d.Path, err)
+		}
+	}
+	return nil
+}
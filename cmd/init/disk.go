@@ -2,15 +2,20 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/gotoz/runq/internal/dmcrypt"
 	"github.com/gotoz/runq/internal/util"
 	"github.com/gotoz/runq/pkg/vm"
 	"golang.org/x/sys/unix"
 )
 
+// diskInfos contains all disks set up inside the VM including the rootdisk.
+var diskInfos []vm.DiskInfo
+
 func setupDisks(disks []vm.Disk) error {
 	for _, disk := range disks {
 		dev, err := findDisk(disk.Serial)
@@ -24,24 +29,63 @@ func setupDisks(disks []vm.Disk) error {
 			return err
 		}
 
+		src := "/dev/" + dev
+		if disk.Crypt != "" {
+			if src, err = openCryptDisk(src, disk); err != nil {
+				return fmt.Errorf("disk %s: %w", disk.ID, err)
+			}
+		}
+
+		if disk.Swap {
+			if err := setupSwap(src, -1); err != nil {
+				return fmt.Errorf("disk %s: %w", disk.ID, err)
+			}
+			diskInfos = append(diskInfos, vm.DiskInfo{Device: dev, Fstype: "swap", ID: disk.ID})
+			continue
+		}
+
 		if !disk.Mount {
+			diskInfos = append(diskInfos, vm.DiskInfo{Device: dev, ID: disk.ID})
 			continue
 		}
 
-		if err := loadKernelModules(disk.Fstype, "/rootfs"); err != nil {
+		fstype := disk.Fstype
+		if fstype == "auto" {
+			fstype, err = detectFstype(src)
+			if err != nil {
+				return fmt.Errorf("disk %s: %w", disk.ID, err)
+			}
+		}
+
+		if err := loadKernelModules(fstype, "/rootfs"); err != nil {
 			return err
 		}
+		if err := checkFilesystemSupport(fstype); err != nil {
+			return fmt.Errorf("disk %s: %w", disk.ID, err)
+		}
+
+		flags := unix.MS_NOSUID | unix.MS_NODEV
+		if fstype == "squashfs" {
+			flags |= unix.MS_RDONLY
+		}
 
 		mnt := vm.Mount{
 			ID:     disk.ID,
-			Source: "/dev/" + dev,
+			Source: src,
 			Target: "/rootfs" + disk.Dir,
-			Fstype: disk.Fstype,
-			Flags:  unix.MS_NOSUID | unix.MS_NODEV,
+			Fstype: fstype,
+			Flags:  flags,
 		}
 		if err := mount(mnt); err != nil {
 			return err
 		}
+		diskInfos = append(diskInfos, vm.DiskInfo{
+			Device:     dev,
+			Fstype:     fstype,
+			ID:         disk.ID,
+			Mountpoint: disk.Dir,
+			Path:       mnt.Target,
+		})
 	}
 	return nil
 }
@@ -69,6 +113,10 @@ func setupRootdisk(vmdata *vm.Data) error {
 		return err
 	}
 
+	if err := loadKernelModules(disk.Fstype, ""); err != nil {
+		return err
+	}
+
 	mnt := vm.Mount{
 		ID:     disk.ID,
 		Source: "/dev/" + dev,
@@ -79,9 +127,79 @@ func setupRootdisk(vmdata *vm.Data) error {
 	if err := mount(mnt); err != nil {
 		return err
 	}
+	diskInfos = append(diskInfos, vm.DiskInfo{
+		Device:     dev,
+		Fstype:     disk.Fstype,
+		ID:         disk.ID,
+		Mountpoint: "/",
+		Path:       mnt.Target,
+	})
 	return nil
 }
 
+// thawDisks thaws filesystems that may have been frozen via vsockd.
+func thawDisks() {
+	for i := len(diskInfos) - 1; i >= 0; i-- {
+		if diskInfos[i].Path == "" {
+			continue
+		}
+		if err := util.ThawFS(diskInfos[i].Path); err != nil {
+			log.Printf("thaw %s failed: %v", diskInfos[i].Path, err)
+		}
+	}
+}
+
+// openCryptDisk unlocks an encrypted disk with dm-crypt and returns the path
+// of the decrypted device. The device is also available as /dev/mapper/<id>.
+func openCryptDisk(dev string, disk vm.Disk) (string, error) {
+	defer func() {
+		for i := range disk.Key {
+			disk.Key[i] = 0
+		}
+	}()
+
+	if err := loadKernelModules("dmcrypt", "/rootfs"); err != nil {
+		return "", err
+	}
+
+	var path string
+	var err error
+	switch disk.Crypt {
+	case "luks":
+		path, err = dmcrypt.OpenLUKS(dev, disk.ID, disk.Key)
+	case "plain":
+		path, err = dmcrypt.OpenPlain(dev, disk.ID, disk.Cipher, disk.Key)
+	default:
+		return "", fmt.Errorf("invalid crypt type %q", disk.Crypt)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll("/dev/mapper", 0755); err != nil {
+		return "", err
+	}
+	if err := os.Symlink("../"+filepath.Base(path), "/dev/mapper/"+disk.ID); err != nil {
+		return "", fmt.Errorf("can't create symlink: %v", err)
+	}
+	return path, nil
+}
+
+// checkFilesystemSupport verifies that the kernel supports a filesystem.
+func checkFilesystemSupport(fstype string) error {
+	buf, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		f := strings.Fields(line)
+		if len(f) > 0 && f[len(f)-1] == fstype {
+			return nil
+		}
+	}
+	return fmt.Errorf("filesystem %q is not supported by the kernel", fstype)
+}
+
 // findDisk searches for a block device in sysfs for a given serial number.
 func findDisk(serial string) (string, error) {
 	files, err := os.ReadDir("/sys/block")
@@ -16,18 +16,32 @@ import (
 
 	"github.com/gotoz/runq/internal/cfg"
 	"github.com/gotoz/runq/pkg/vm"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
 )
 
+// execSyncFd is the write end of the exec pipe. It is closed by the exec of
+// the entrypoint program. A byte is written if the entrypoint fails before.
+const execSyncFd = 5
+
 func mainEntrypoint() {
 	if err := runEntrypoint(); err != nil {
+		execFailed()
 		log.Fatalf("runEntrypoint failed: %v", err)
 	}
 }
 
+// execFailed tells init that the entrypoint program won't be executed.
+func execFailed() {
+	unix.Write(execSyncFd, []byte{1})
+}
+
 func runEntrypoint() error {
 	runtime.LockOSThread()
 
+	// Hooks and other children must not keep the exec pipe open.
+	unix.CloseOnExec(execSyncFd)
+
 	rd := os.NewFile(uintptr(3), "rd")
 	if rd == nil {
 		return fmt.Errorf("FH 3 == nil")
@@ -45,7 +59,16 @@ func runEntrypoint() error {
 		return fmt.Errorf("vm.DecodeEntrypointGob failed: %w", err)
 	}
 
-	if err := mountEntrypointStage0(); err != nil {
+	if os.Args[0] == nsexecEntrypoint {
+		return finalizeEntrypoint(entrypoint)
+	}
+
+	// Ids of files are seen from outside of the user namespace.
+	uid := hostID(entrypoint.UID, entrypoint.UIDMappings)
+	gid := hostID(entrypoint.GID, entrypoint.GIDMappings)
+	ttyGID := hostID(5, entrypoint.GIDMappings)
+
+	if err := mountEntrypointStage0(ttyGID); err != nil {
 		return fmt.Errorf("mountEntrypointStage0 failed: %w", err)
 	}
 
@@ -59,6 +82,19 @@ func runEntrypoint() error {
 		return fmt.Errorf("chroot failed: %w", err)
 	}
 
+	if hasNamespace(entrypoint.Namespaces, "uts") {
+		if entrypoint.Hostname != "" {
+			if err := unix.Sethostname([]byte(entrypoint.Hostname)); err != nil {
+				return fmt.Errorf("sethostname failed: %w", err)
+			}
+		}
+		if entrypoint.Domainname != "" {
+			if err := unix.Setdomainname([]byte(entrypoint.Domainname)); err != nil {
+				return fmt.Errorf("setdomainname failed: %w", err)
+			}
+		}
+	}
+
 	if entrypoint.Runqenv {
 		if err := writeEnvfile(cfg.Envfile, entrypoint.Env); err != nil {
 			return fmt.Errorf("writeEnvfile %s failed: %w", cfg.Envfile, err)
@@ -66,33 +102,84 @@ func runEntrypoint() error {
 		if err := os.Chmod(cfg.Envfile, 0400); err != nil {
 			return fmt.Errorf("chmod %s failed: %v", cfg.Envfile, err)
 		}
-		if err := os.Chown(cfg.Envfile, int(entrypoint.UID), int(entrypoint.GID)); err != nil {
+		if err := os.Chown(cfg.Envfile, uid, gid); err != nil {
 			return fmt.Errorf("chown %s failed: %v", cfg.Envfile, err)
 		}
 	}
 
-	if !entrypoint.Systemd {
+	if entrypoint.Cgroup == "v2" {
+		if err := mountEntrypointCgroup2(entrypoint.Resources); err != nil {
+			return fmt.Errorf("mountEntrypointCgroup2 failed: %w", err)
+		}
+	} else {
 		if err := mountEntrypointCgroups(); err != nil {
 			return fmt.Errorf("mountEntrypointCgroups failed: %w", err)
 		}
+		if err := setCgroup1Resources(entrypoint.Resources); err != nil {
+			return fmt.Errorf("setCgroup1Resources failed: %w", err)
+		}
+		cgroupns := hasNamespace(entrypoint.Namespaces, "cgroup")
+		if cgroupns {
+			if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+				return fmt.Errorf("unshare cgroup namespace failed: %w", err)
+			}
+		}
+		// Systemd mounts the cgroup hierarchies itself. In a new cgroup
+		// namespace the hierarchies are mounted again with the cgroup of
+		// the entrypoint as root.
+		if entrypoint.Systemd || cgroupns {
+			if err := unix.Unmount("/sys/fs/cgroup", unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+				return fmt.Errorf("unmount /sys/fs/cgroup failed: %w", err)
+			}
+		}
+		if cgroupns && !entrypoint.Systemd {
+			if err := mountEntrypointCgroups(); err != nil {
+				return fmt.Errorf("mountEntrypointCgroups failed: %w", err)
+			}
+		}
 	}
 
-	if err := maskPath(cfg.MaskedPaths); err != nil {
+	if err := runHooks(entrypoint.Hooks.CreateContainer, entrypoint.Hooks.State, specs.StateCreating, os.Getpid(), ""); err != nil {
+		return fmt.Errorf("createContainer hooks failed: %w", err)
+	}
+
+	maskedPaths, readonlyPaths := systemPaths(entrypoint)
+	if err := maskPath(maskedPaths); err != nil {
 		return fmt.Errorf("maskPath failed: %w", err)
 	}
 
-	if err := readonlyPath(cfg.ReadonlyPaths); err != nil {
+	if err := readonlyPath(readonlyPaths); err != nil {
 		return fmt.Errorf("readonlyPath failed: %w", err)
 	}
 
-	if err := prepareDeviceFiles(int(entrypoint.UID)); err != nil {
+	if err := prepareDeviceFiles(uid, ttyGID); err != nil {
 		return fmt.Errorf("prepareDeviceFiles failed: %w", err)
 	}
 
+	if err := createDevices(entrypoint.Devices, entrypoint.UIDMappings, entrypoint.GIDMappings); err != nil {
+		return fmt.Errorf("createDevices failed: %w", err)
+	}
+
 	if err := setRlimits(entrypoint.Rlimits); err != nil {
 		return fmt.Errorf("setRlimits failed: %w", err)
 	}
 
+	if err := setOOMScoreAdj(entrypoint.OOMScoreAdj); err != nil {
+		return fmt.Errorf("setOOMScoreAdj failed: %w", err)
+	}
+
+	if err := setIOPriority(entrypoint.IOPriority); err != nil {
+		return fmt.Errorf("setIOPriority failed: %w", err)
+	}
+
+	if err := setScheduler(entrypoint.Scheduler); err != nil {
+		return fmt.Errorf("setScheduler failed: %w", err)
+	}
+
+	if err := setPersonality(entrypoint.Personality); err != nil {
+		return fmt.Errorf("setPersonality failed: %w", err)
+	}
+
 	if entrypoint.NoNewPrivileges {
 		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
 			return fmt.Errorf("unix.Prctl() failed: %w", err)
@@ -103,24 +190,67 @@ func runEntrypoint() error {
 		return fmt.Errorf("os.Chdir failed: %w", err)
 	}
 
-	if err := dropCapabilities(entrypoint.Capabilities); err != nil {
-		return fmt.Errorf("dropCapabilities failed: %w", err)
+	// Time and user namespaces are created in a new process image.
+	if hasNamespace(entrypoint.Namespaces, "time") || len(entrypoint.UIDMappings) > 0 {
+		return execNamespaces(entrypoint)
+	}
+	return finalizeEntrypoint(entrypoint)
+}
+
+// finalizeEntrypoint sets capabilities, seccomp and ids and executes the
+// entrypoint program.
+func finalizeEntrypoint(entrypoint *vm.Entrypoint) error {
+	if err := runHooks(entrypoint.Hooks.StartContainer, entrypoint.Hooks.State, specs.StateCreated, os.Getpid(), ""); err != nil {
+		return fmt.Errorf("startContainer hooks failed: %w", err)
 	}
 
-	if err := initSeccomp(entrypoint.SeccompGob); err != nil {
-		return fmt.Errorf("initSeccomp failed: %w", err)
+	caps, err := newCapabilities(entrypoint.Capabilities)
+	if err != nil {
+		return fmt.Errorf("newCapabilities failed: %w", err)
+	}
+
+	// Without no_new_privs seccomp requires CAP_SYS_ADMIN and therefore must
+	// be initialized before capabilities are dropped. Same as in runc.
+	if !entrypoint.NoNewPrivileges {
+		if err := initSeccomp(entrypoint.SeccompGob); err != nil {
+			return fmt.Errorf("initSeccomp failed: %w", err)
+		}
 	}
 
 	if err := setPATH(entrypoint.Env); err != nil {
 		return fmt.Errorf("setPATH failed: %w", err)
 	}
 
+	if err := caps.applyBounding(); err != nil {
+		return fmt.Errorf("applyBounding failed: %w", err)
+	}
+
+	// Keep the permitted capabilities when switching to a non-root user.
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("set keep caps failed: %w", err)
+	}
+
 	if err := setIDs(entrypoint.UID, entrypoint.GID, entrypoint.AdditionalGids); err != nil {
 		return fmt.Errorf("setIDs failed: %w", err)
 	}
 
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("clear keep caps failed: %w", err)
+	}
+
+	if err := caps.apply(); err != nil {
+		return fmt.Errorf("apply capabilities failed: %w", err)
+	}
+
+	if entrypoint.NoNewPrivileges {
+		if err := initSeccomp(entrypoint.SeccompGob); err != nil {
+			return fmt.Errorf("initSeccomp failed: %w", err)
+		}
+	}
+
 	path, err := exec.LookPath(os.Args[1])
 	if err != nil {
+		execFailed()
 		fmt.Fprint(os.Stderr, err)
 		if errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EISDIR) {
 			os.Exit(126)
@@ -151,8 +281,8 @@ func chroot(dir string) error {
 	return nil
 }
 
-func prepareDeviceFiles(uid int) error {
-	if err := os.Chown("/dev/console", uid, 5); err != nil {
+func prepareDeviceFiles(uid, ttyGID int) error {
+	if err := os.Chown("/dev/console", uid, ttyGID); err != nil {
 		return fmt.Errorf("os.Chown /dev/console failed: %w", err)
 	}
 	if err := os.Chmod("/dev/console", 0620); err != nil {
@@ -201,6 +331,24 @@ func setRlimits(limits map[string]syscall.Rlimit) error {
 	return nil
 }
 
+// systemPaths returns the paths to mask and to make read-only as requested
+// by the spec. A spec without both lists asks for unconfined system paths
+// (--security-opt systempaths=unconfined). A single missing list falls back
+// to the runq defaults.
+func systemPaths(entrypoint *vm.Entrypoint) ([]string, []string) {
+	masked, readonly := entrypoint.MaskedPaths, entrypoint.ReadonlyPaths
+	if len(masked) == 0 && len(readonly) == 0 {
+		return nil, nil
+	}
+	if len(masked) == 0 {
+		masked = cfg.MaskedPaths
+	}
+	if len(readonly) == 0 {
+		readonly = cfg.ReadonlyPaths
+	}
+	return masked, readonly
+}
+
 func setPATH(env []string) error {
 	for _, v := range env {
 		s := strings.SplitN(v, "=", 2)
@@ -11,46 +11,67 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func newEntrypoint(entrypoint vm.Entrypoint) (*exec.Cmd, error) {
+// newEntrypoint starts the entrypoint process. The entrypoint data is passed
+// as file descriptor 3, the optional seccomp socket as file descriptor 4 and
+// the write end of the exec pipe as file descriptor 5. The returned read end
+// of the exec pipe reaches EOF once the entrypoint program has been executed.
+func newEntrypoint(entrypoint vm.Entrypoint, seccompSock *os.File) (*exec.Cmd, *os.File, error) {
 	runtime.LockOSThread()
 	dataReader, dataWriter, err := os.Pipe()
 	if err != nil {
-		return nil, fmt.Errorf("os.Pipe() failed: %w", err)
+		return nil, nil, fmt.Errorf("os.Pipe() failed: %w", err)
+	}
+	execReader, execWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("os.Pipe() failed: %w", err)
+	}
+
+	cloneflags := unix.CLONE_NEWPID | unix.CLONE_NEWNS | unix.CLONE_NEWIPC
+	if hasNamespace(entrypoint.Namespaces, "uts") {
+		cloneflags |= unix.CLONE_NEWUTS
 	}
 
 	cmd := &exec.Cmd{
 		Path:       "/proc/self/exe",
 		Args:       append([]string{"entrypoint"}, entrypoint.Args...),
-		ExtraFiles: []*os.File{dataReader},
+		ExtraFiles: []*os.File{dataReader, seccompSock, execWriter},
 		Stdout:     os.Stdout,
 		Stderr:     os.Stderr,
 		Stdin:      os.Stdin,
 		SysProcAttr: &unix.SysProcAttr{
 			Setsid:     true,
 			Setctty:    true,
-			Cloneflags: unix.CLONE_NEWPID | unix.CLONE_NEWNS | unix.CLONE_NEWIPC,
+			Cloneflags: uintptr(cloneflags),
 		},
 	}
 
 	if err := cmd.Start(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if err := dataReader.Close(); err != nil {
-		return nil, fmt.Errorf("dataReader.Close() failed: %w", err)
+		return nil, nil, fmt.Errorf("dataReader.Close() failed: %w", err)
+	}
+	if err := execWriter.Close(); err != nil {
+		return nil, nil, fmt.Errorf("execWriter.Close() failed: %w", err)
+	}
+	if seccompSock != nil {
+		if err := seccompSock.Close(); err != nil {
+			return nil, nil, fmt.Errorf("seccompSock.Close() failed: %w", err)
+		}
 	}
 
 	gob, err := vm.Encode(entrypoint)
 	if err != nil {
-		return nil, fmt.Errorf("vm.Encode() failed: %w", err)
+		return nil, nil, fmt.Errorf("vm.Encode() failed: %w", err)
 	}
 	if _, err := dataWriter.Write(gob); err != nil {
-		return nil, fmt.Errorf("dataWriter.Write() failed: %w", err)
+		return nil, nil, fmt.Errorf("dataWriter.Write() failed: %w", err)
 	}
 	if err := dataWriter.Close(); err != nil {
-		return nil, fmt.Errorf("dataWriter.Close() failed: %w", err)
+		return nil, nil, fmt.Errorf("dataWriter.Close() failed: %w", err)
 	}
-	return cmd, nil
+	return cmd, execReader, nil
 }
 
 func newVsockd(vsockd vm.Vsockd, nspid int) (*exec.Cmd, error) {
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// detectFstype reads the superblock of a block device and returns the
+// filesystem type.
+func detectFstype(dev string) (string, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The btrfs superblock is at 64k, everything else within the first 4k.
+	buf := make([]byte, 0x10048)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("read superblock of %s failed: %w", dev, err)
+	}
+	buf = buf[:n]
+
+	at := func(off int, magic []byte) bool {
+		return len(buf) >= off+len(magic) && bytes.Equal(buf[off:off+len(magic)], magic)
+	}
+	le16 := func(off int) uint16 {
+		if len(buf) < off+2 {
+			return 0
+		}
+		return binary.LittleEndian.Uint16(buf[off:])
+	}
+	le32 := func(off int) uint32 {
+		if len(buf) < off+4 {
+			return 0
+		}
+		return binary.LittleEndian.Uint32(buf[off:])
+	}
+
+	switch {
+	case at(0, []byte("hsqs")):
+		return "squashfs", nil
+	case at(0, []byte("XFSB")):
+		return "xfs", nil
+	case le16(1080) == 0xEF53:
+		const (
+			compatHasJournal = 0x4
+			incompatExt4     = 0x40 | 0x80 | 0x200 // extents, 64bit, flex_bg
+		)
+		switch {
+		case le32(1024+0x60)&incompatExt4 != 0:
+			return "ext4", nil
+		case le32(1024+0x5C)&compatHasJournal != 0:
+			return "ext3", nil
+		}
+		return "ext2", nil
+	case le32(0x400) == 0xF2F52010:
+		return "f2fs", nil
+	case at(0x10040, []byte("_BHRfS_M")):
+		return "btrfs", nil
+	case le16(510) == 0xAA55 && (at(0x36, []byte("FAT")) || at(0x52, []byte("FAT32"))):
+		return "vfat", nil
+	}
+	return "", fmt.Errorf("unknown filesystem on %s", dev)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/gotoz/runq/pkg/vm"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// runHooks executes the hooks in the given order. Each hook receives the
+// OCI state of the container on stdin. Hooks are executed in the directory
+// root if not empty.
+func runHooks(hooks []vm.Hook, state []byte, status specs.ContainerState, pid int, root string) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	var s specs.State
+	if err := json.Unmarshal(state, &s); err != nil {
+		return fmt.Errorf("invalid container state: %w", err)
+	}
+	s.Status = status
+	s.Pid = pid
+	stdin, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hooks {
+		if err := runHook(h, stdin, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPoststartHooks waits until the entrypoint program has been executed and
+// runs the poststart hooks. Failing hooks don't stop the container. Same as
+// in runc.
+func runPoststartHooks(execSync *os.File, hooks vm.Hooks, pid int) {
+	defer execSync.Close()
+	if n, _ := execSync.Read(make([]byte, 1)); n > 0 {
+		return
+	}
+	if err := runHooks(hooks.Poststart, hooks.State, specs.StateRunning, pid, "/rootfs"); err != nil {
+		log.Printf("poststart hooks failed: %v", err)
+	}
+}
+
+func runHook(h vm.Hook, stdin []byte, root string) error {
+	ctx := context.Background()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, h.Path)
+	if len(h.Args) > 0 {
+		cmd.Args = h.Args
+	}
+	cmd.Env = h.Env
+	cmd.Stdin = bytes.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if root != "" {
+		cmd.SysProcAttr = &unix.SysProcAttr{Chroot: root}
+		cmd.Dir = "/"
+	}
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timeout after %ds", h.Timeout)
+		}
+		return fmt.Errorf("hook %s failed: %w: %s", h.Path, err, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
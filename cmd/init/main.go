@@ -34,7 +34,7 @@ func init() {
 
 func main() {
 	switch os.Args[0] {
-	case "entrypoint":
+	case "entrypoint", nsexecEntrypoint:
 		mainEntrypoint()
 		return
 	case "/sbin/modprobe":
@@ -65,7 +65,7 @@ func runInit() error {
 		return err
 	}
 
-	vportDev, err := vportDevice()
+	vportDev, err := vportDevice(vm.ChannelPort)
 	if err != nil {
 		return err
 	}
@@ -116,18 +116,28 @@ func runInit() error {
 		}
 	}
 
+	if vmdata.Share == "virtiofs" {
+		if err := loadKernelModules("virtiofs", ""); err != nil {
+			return err
+		}
+	}
+
 	// By default the 9pfs share contains the container root filesystem
 	// including /lib/modules.
 	// When using a rootdisk the 9pfs share contains only /lib/modules
 	if vmdata.Rootdisk == "" {
-		if err := mountInitShare("rootfs", "/rootfs", vmdata.Cache9p); err != nil {
+		if vmdata.RootfsOverlay != "" {
+			if err := setupRootfsOverlay(vmdata); err != nil {
+				return err
+			}
+		} else if err := mountInitShare("rootfs", "/rootfs", vmdata); err != nil {
 			return err
 		}
 	} else {
 		if err := setupRootdisk(vmdata); err != nil {
 			return err
 		}
-		if err := mountInitShare("share", "/rootfs/lib/modules", vmdata.Cache9p); err != nil {
+		if err := mountInitShare("share", "/rootfs/lib/modules", vmdata); err != nil {
 			return err
 		}
 	}
@@ -140,6 +150,10 @@ func runInit() error {
 		return fmt.Errorf("init: remove empty mountpoint failed: %w", err)
 	}
 
+	if err := mountShares9p(vmdata.Shares9p, vmdata.Cache9p); err != nil {
+		return err
+	}
+
 	if err := mountInitStage1(vmdata.Mounts); err != nil {
 		return err
 	}
@@ -159,12 +173,39 @@ func runInit() error {
 		return err
 	}
 
+	if vmdata.Zram > 0 {
+		if err := setupZram(vmdata.Zram); err != nil {
+			return err
+		}
+	}
+
 	if vmdata.APDevice != "" {
 		if err := setupAPDevice(); err != nil {
 			return err
 		}
 	}
 
+	if vmdata.ReadonlyRootfs {
+		// The env file can't be written by the entrypoint later.
+		if vmdata.Entrypoint.Runqenv {
+			if err := writeEnvfile("/rootfs"+cfg.Envfile, vmdata.Entrypoint.Env); err != nil {
+				return err
+			}
+			if err := os.Chmod("/rootfs"+cfg.Envfile, 0400); err != nil {
+				return err
+			}
+			uid := hostID(vmdata.Entrypoint.UID, vmdata.Entrypoint.UIDMappings)
+			gid := hostID(vmdata.Entrypoint.GID, vmdata.Entrypoint.GIDMappings)
+			if err := os.Chown("/rootfs"+cfg.Envfile, uid, gid); err != nil {
+				return err
+			}
+			vmdata.Entrypoint.Runqenv = false
+		}
+		if err := readonlyRootfs(vmdata.Volumes); err != nil {
+			return err
+		}
+	}
+
 	// Start reaper to wait4 zombie processes.
 	go reaper()
 
@@ -172,18 +213,43 @@ func runInit() error {
 		return fmt.Errorf("init: setModprobe() failed: %v", err)
 	}
 
+	if len(vmdata.Entrypoint.Devices) > 0 {
+		rules, err := setupDevices(vmdata.Entrypoint.Devices, vmdata.Entrypoint.Resources.Devices)
+		if err != nil {
+			return fmt.Errorf("init: setupDevices() failed: %v", err)
+		}
+		vmdata.Entrypoint.Resources.Devices = rules
+	}
+
+	// The device rules of the spec don't cover the devices of the VM.
+	if len(vmdata.Entrypoint.Resources.Devices) > 0 {
+		rules := guestDeviceRules(vmdata.APDevice != "")
+		vmdata.Entrypoint.Resources.Devices = append(vmdata.Entrypoint.Resources.Devices, rules...)
+	}
+
 	// Start entrypoint process.
-	entrypoint, err := newEntrypoint(vmdata.Entrypoint)
+	var seccompSock, seccompSockChild *os.File
+	if vmdata.SeccompAgent != nil {
+		if seccompSock, seccompSockChild, err = newSeccompSocket(); err != nil {
+			shutdown(util.ErrorToRc(err))
+		}
+	}
+	entrypoint, execSync, err := newEntrypoint(vmdata.Entrypoint, seccompSockChild)
 	if err != nil {
 		shutdown(util.ErrorToRc(err))
 	}
 	pidEntrypoint := entrypoint.Process.Pid
+	if seccompSock != nil {
+		go forwardSeccompNotifications(seccompSock, vmdata.SeccompAgent, pidEntrypoint)
+	}
+	go runPoststartHooks(execSync, vmdata.Entrypoint.Hooks, pidEntrypoint)
 	go wait4Entrypoint(pidEntrypoint, vmdata.Entrypoint.Systemd)
 
 	// Start vsockd process.
 	if vmdata.Vsockd.CID != 0 {
 		vmdata.Vsockd.EntrypointPid = pidEntrypoint
 		vmdata.Vsockd.EntrypointEnv = vmdata.Entrypoint.Env
+		vmdata.Vsockd.Disks = diskInfos
 		vsockd, err := newVsockd(vmdata.Vsockd, pidEntrypoint)
 		if err != nil {
 			log.Printf("init: newVsockd() failed: %v", err)
@@ -272,23 +338,21 @@ func signalProcess(pid int, sig unix.Signal) error {
 	return proc.Signal(sig)
 }
 
-func vportDevice() (string, error) {
-	var vports []os.DirEntry
-	var err error
+// vportDevice returns the device file of the virtio serial port with the
+// given name.
+func vportDevice(name string) (string, error) {
+	const dir = "/sys/class/virtio-ports"
 	for i := 0; i < 100; i++ {
-		vports, err = os.ReadDir("/sys/class/virtio-ports")
-		if len(vports) == 1 {
-			break
+		vports, _ := os.ReadDir(dir)
+		for _, v := range vports {
+			buf, err := os.ReadFile(filepath.Join(dir, v.Name(), "name"))
+			if err == nil && strings.TrimSpace(string(buf)) == name {
+				return "/dev/" + v.Name(), nil
+			}
 		}
 		time.Sleep(time.Millisecond * 10)
 	}
-	if err != nil {
-		return "", fmt.Errorf("init vportDevice(): os.ReadDir failed: %w", err)
-	}
-	if len(vports) != 1 {
-		return "", fmt.Errorf("init vportDevice(): found %d vports. Expected 1", len(vports))
-	}
-	return "/dev/" + vports[0].Name(), nil
+	return "", fmt.Errorf("init vportDevice(): vport %s not found", name)
 }
 
 func loadKernelModules(kind, prefix string) error {
@@ -389,10 +453,20 @@ func shutdown(rc uint8, msg string) {
 			log.Println("<- ackChan timed out")
 		}
 
+		if rootfsWriteback != nil {
+			util.Killall()
+			thawDisks()
+			unix.Sync()
+			if err := rootfsWriteback(); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		}
+
 		ch := make(chan int, 1)
 		go func() {
 			util.SetSysctl("kernel.printk", "0")
 			util.Killall()
+			thawDisks()
 			os.RemoveAll("/rootfs" + vm.QemuMountPt)
 			unix.Sync()
 			umountInit()
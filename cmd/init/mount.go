@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gotoz/runq/internal/util"
@@ -14,6 +15,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// cgroupLeaf is the cgroup v2 of the entrypoint.
+const cgroupLeaf = "container"
+
 func mountInitStage0() error {
 	mounts := []vm.Mount{
 		{
@@ -46,17 +50,56 @@ func mountInitStage0() error {
 	return mount(mounts...)
 }
 
-func mountInitShare(source, target, cache9p string) error {
+func mountInitShare(source, target string, vmdata *vm.Data) error {
+	if vmdata.Share == "virtiofs" {
+		var data string
+		if vmdata.VirtiofsDAX {
+			data = "dax"
+		}
+		mnt := vm.Mount{
+			Source: source,
+			Target: target,
+			Fstype: "virtiofs",
+			Flags:  unix.MS_NODEV,
+			Data:   data,
+		}
+		return mount(mnt)
+	}
 	mnt := vm.Mount{
 		Source: source,
 		Target: target,
 		Fstype: "9p",
 		Flags:  unix.MS_NODEV | unix.MS_DIRSYNC,
-		Data:   "trans=virtio,cache=" + cache9p,
+		Data:   "trans=virtio,cache=" + vmdata.Cache9p,
 	}
 	return mount(mnt)
 }
 
+// mountShares9p mounts the 9p shares of single volumes.
+func mountShares9p(shares []vm.Share9p, cache9p string) error {
+	for _, s := range shares {
+		cache := s.Cache
+		if cache == "" {
+			cache = cache9p
+		}
+		flags := unix.MS_NODEV | unix.MS_DIRSYNC
+		if s.Readonly {
+			flags |= unix.MS_RDONLY
+		}
+		mnt := vm.Mount{
+			Source: s.Tag,
+			Target: "/rootfs" + s.Target,
+			Fstype: "9p",
+			Flags:  flags,
+			Data:   "trans=virtio,cache=" + cache,
+		}
+		if err := mount(mnt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func mountInitStage1(extraMounts []vm.Mount) error {
 	for i := range extraMounts {
 		extraMounts[i].Target = "/rootfs" + extraMounts[i].Target
@@ -64,7 +107,7 @@ func mountInitStage1(extraMounts []vm.Mount) error {
 	return mount(extraMounts...)
 }
 
-func mountEntrypointStage0() error {
+func mountEntrypointStage0(ttyGID int) error {
 	mounts := []vm.Mount{
 		{
 			Source: "proc",
@@ -90,7 +133,7 @@ func mountEntrypointStage0() error {
 			Target: "/rootfs/dev/pts",
 			Fstype: "devpts",
 			Flags:  unix.MS_NOSUID | unix.MS_NOEXEC,
-			Data:   "newinstance,gid=5,mode=0620,ptmxmode=000",
+			Data:   fmt.Sprintf("newinstance,gid=%d,mode=0620,ptmxmode=000", ttyGID),
 		},
 		{
 			Source: "shm",
@@ -201,6 +244,58 @@ func mount(mounts ...vm.Mount) error {
 	return nil
 }
 
+// mountEntrypointCgroup2 mounts the cgroup v2 unified hierarchy. All available
+// controllers are enabled and the entrypoint is moved into its own leaf cgroup
+// with the given resource limits. A new cgroup namespace makes the leaf the
+// root cgroup of the container.
+func mountEntrypointCgroup2(res vm.Resources) error {
+	const root = "/sys/fs/cgroup"
+	if err := checkFilesystemSupport("cgroup2"); err != nil {
+		return err
+	}
+	mnt := vm.Mount{
+		Source: "cgroup2",
+		Target: root,
+		Fstype: "cgroup2",
+		Flags:  unix.MS_NOSUID | unix.MS_NOEXEC | unix.MS_NODEV,
+		Data:   "nsdelegate",
+	}
+	if err := mount(mnt); err != nil {
+		return err
+	}
+
+	buf, err := os.ReadFile(root + "/cgroup.controllers")
+	if err != nil {
+		return err
+	}
+	for _, c := range strings.Fields(string(buf)) {
+		if err := os.WriteFile(root+"/cgroup.subtree_control", []byte("+"+c), 0); err != nil {
+			log.Printf("enable cgroup controller %s failed: %v", c, err)
+		}
+	}
+
+	leaf := root + "/" + cgroupLeaf
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := setCgroup2Resources(leaf, res); err != nil {
+		return err
+	}
+	if err := os.WriteFile(leaf+"/cgroup.procs", []byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		return fmt.Errorf("move entrypoint into cgroup %s failed: %w", leaf, err)
+	}
+
+	// The calling thread is locked and later executes the entrypoint.
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		return fmt.Errorf("unshare cgroup namespace failed: %w", err)
+	}
+	if err := unix.Unmount(root, unix.MNT_DETACH); err != nil {
+		return err
+	}
+	mnt.Data = "" // nsdelegate is only valid in the initial cgroup namespace
+	return mount(mnt)
+}
+
 func bindMountFile(src, target string) error {
 	dir := filepath.Dir(target)
 	if !util.DirExists(dir) {
@@ -219,6 +314,24 @@ func bindMountFile(src, target string) error {
 	return nil
 }
 
+// readonlyRootfs makes /rootfs read-only. Volumes are bind-mounted onto
+// themselves first to keep them writable.
+func readonlyRootfs(volumes []string) error {
+	for _, v := range volumes {
+		p := "/rootfs" + v
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		if err := unix.Mount(p, p, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mount %s failed: %v", p, err)
+		}
+	}
+	if err := unix.Mount("/rootfs", "/rootfs", "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remount /rootfs read-only failed: %v", err)
+	}
+	return nil
+}
+
 // readonlyPath will make paths read only.
 func readonlyPath(paths []string) error {
 	for _, p := range paths {
@@ -278,7 +391,7 @@ func umountInit() {
 					continue
 				}
 				switch f[2] {
-				case "ext2", "ext3", "ext4", "xfs", "btrfs":
+				case "ext2", "ext3", "ext4", "xfs", "btrfs", "vfat", "f2fs", "squashfs":
 					dirs = append([]string{f[1]}, dirs...)
 				}
 			}
@@ -0,0 +1,147 @@
+#define _GNU_SOURCE
+#include <errno.h>
+#include <fcntl.h>
+#include <sched.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/types.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+#ifndef CLONE_NEWTIME
+#define CLONE_NEWTIME 0x00000080
+#endif
+
+static int write_file(const char *path, const char *data)
+{
+	ssize_t len = strlen(data);
+	int fd;
+
+	fd = open(path, O_WRONLY);
+	if (fd == -1) {
+		fprintf(stderr, "failed to open %s: %s\n", path, strerror(errno));
+		return -1;
+	}
+	// Mappings and offsets must be written with a single write.
+	if (write(fd, data, len) != len) {
+		fprintf(stderr, "failed to write %s: %s\n", path, strerror(errno));
+		close(fd);
+		return -1;
+	}
+	close(fd);
+	return 0;
+}
+
+// timens creates a new time namespace with the given clock offsets and
+// enters it. Offsets can only be set before the first process enters.
+static int timens(const char *offsets)
+{
+	int fd;
+
+	if (unshare(CLONE_NEWTIME) == -1) {
+		perror("unshare time namespace failed");
+		return -1;
+	}
+	if (*offsets != '\0' && write_file("/proc/self/timens_offsets", offsets) == -1) {
+		return -1;
+	}
+	fd = open("/proc/self/ns/time_for_children", O_RDONLY);
+	if (fd == -1) {
+		perror("failed to open /proc/self/ns/time_for_children");
+		return -1;
+	}
+	if (setns(fd, CLONE_NEWTIME) == -1) {
+		perror("setns time failed");
+		return -1;
+	}
+	close(fd);
+	return 0;
+}
+
+// userns creates a new user namespace and a new mount namespace owned by
+// it. The id mappings are written by a child that stays in the parent user
+// namespace with all capabilities.
+static int userns(const char *uidmap, const char *gidmap)
+{
+	char uidmap_path[64], gidmap_path[64];
+	pid_t pid;
+	int sync[2];
+	int wstatus;
+	char c = 0;
+
+	if (pipe(sync) == -1) {
+		perror("pipe failed");
+		return -1;
+	}
+	sprintf(uidmap_path, "/proc/%d/uid_map", getpid());
+	sprintf(gidmap_path, "/proc/%d/gid_map", getpid());
+
+	switch (pid = fork()) {
+	case -1:
+		perror("fork failed");
+		return -1;
+	case 0:
+		// child
+		close(sync[1]);
+		if (read(sync[0], &c, 1) != 1) {
+			_exit(1);
+		}
+		if (write_file(uidmap_path, uidmap) == -1) {
+			_exit(1);
+		}
+		if (write_file(gidmap_path, gidmap) == -1) {
+			_exit(1);
+		}
+		_exit(0);
+	}
+
+	// parent
+	close(sync[0]);
+	if (unshare(CLONE_NEWUSER) == -1) {
+		perror("unshare user namespace failed");
+		return -1;
+	}
+	if (write(sync[1], &c, 1) != 1) {
+		perror("write sync failed");
+		return -1;
+	}
+	close(sync[1]);
+
+	if (waitpid(pid, &wstatus, 0) == -1) {
+		perror("waitpid failed");
+		return -1;
+	}
+	if (!WIFEXITED(wstatus) || WEXITSTATUS(wstatus) != 0) {
+		fprintf(stderr, "failed to write id mappings\n");
+		return -1;
+	}
+
+	if (unshare(CLONE_NEWNS) == -1) {
+		perror("unshare mount namespace failed");
+		return -1;
+	}
+	return 0;
+}
+
+// nsexec moves the entrypoint into new time and user namespaces. Joining a
+// time or user namespace requires a single threaded process, therefore this
+// runs as constructor before the Go runtime starts. The time namespace is
+// created first to keep it owned by the initial user namespace.
+void __attribute__((constructor)) nsexec(void)
+{
+	const char *offsets = getenv("_RUNQ_TIMENS");
+	const char *uidmap = getenv("_RUNQ_UIDMAP");
+	const char *gidmap = getenv("_RUNQ_GIDMAP");
+
+	if (offsets != NULL && timens(offsets) == -1) {
+		exit(1);
+	}
+	if (uidmap != NULL && gidmap != NULL && userns(uidmap, gidmap) == -1) {
+		exit(1);
+	}
+
+	unsetenv("_RUNQ_TIMENS");
+	unsetenv("_RUNQ_UIDMAP");
+	unsetenv("_RUNQ_GIDMAP");
+}
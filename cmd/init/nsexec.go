@@ -0,0 +1,114 @@
+package main
+
+// The time and user namespaces of the entrypoint are created by the
+// constructor in nsexec.c.
+
+// #cgo CFLAGS: -Wall
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gotoz/runq/pkg/vm"
+	"golang.org/x/sys/unix"
+)
+
+// nsexecEntrypoint is the name of the entrypoint process after it has been
+// moved into the time and user namespaces.
+const nsexecEntrypoint = "entrypoint-nsexec"
+
+// overflowID is the id of unmapped users and groups.
+const overflowID = 65534
+
+// execNamespaces re-executes the entrypoint with the time offsets and id
+// mappings in the environment. The entrypoint data is passed as file
+// descriptor 3, the exec pipe stays at file descriptor 5.
+func execNamespaces(entrypoint *vm.Entrypoint) error {
+	gob, err := vm.Encode(entrypoint)
+	if err != nil {
+		return fmt.Errorf("vm.Encode() failed: %w", err)
+	}
+	fd, err := unix.MemfdCreate("entrypoint", unix.MFD_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("memfd_create failed: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "entrypoint")
+	if _, err := f.Write(gob); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	if fd == 3 {
+		_, err = unix.FcntlInt(uintptr(fd), unix.F_SETFD, 0)
+	} else {
+		err = unix.Dup3(fd, 3, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("pass entrypoint data failed: %w", err)
+	}
+	if _, err := unix.FcntlInt(execSyncFd, unix.F_SETFD, 0); err != nil {
+		return fmt.Errorf("pass exec pipe failed: %w", err)
+	}
+
+	var env []string
+	if hasNamespace(entrypoint.Namespaces, "time") {
+		env = append(env, "_RUNQ_TIMENS="+timeOffsetsString(entrypoint.TimeOffsets))
+	}
+	if len(entrypoint.UIDMappings) > 0 {
+		env = append(env,
+			"_RUNQ_UIDMAP="+idMapString(entrypoint.UIDMappings),
+			"_RUNQ_GIDMAP="+idMapString(entrypoint.GIDMappings),
+		)
+	}
+	args := append([]string{nsexecEntrypoint}, os.Args[1:]...)
+	if err := unix.Exec("/proc/self/exe", args, env); err != nil {
+		return fmt.Errorf("unix.Exec failed: %w", err)
+	}
+	return nil
+}
+
+// timeOffsetsString returns the offsets in the format of
+// /proc/<pid>/timens_offsets.
+func timeOffsetsString(offsets map[string]vm.TimeOffset) string {
+	var sb strings.Builder
+	for clock, o := range offsets {
+		fmt.Fprintf(&sb, "%s %d %d\n", clock, o.Secs, o.Nanosecs)
+	}
+	return sb.String()
+}
+
+// hasNamespace returns whether the namespace type is in the list.
+func hasNamespace(namespaces []string, typ string) bool {
+	for _, ns := range namespaces {
+		if ns == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// idMapString returns the mappings in the format of /proc/<pid>/uid_map.
+func idMapString(mappings []vm.IDMap) string {
+	var sb strings.Builder
+	for _, m := range mappings {
+		fmt.Fprintf(&sb, "%d %d %d\n", m.ContainerID, m.HostID, m.Size)
+	}
+	return sb.String()
+}
+
+// hostID returns the id outside of the user namespace for a given id
+// inside the user namespace.
+func hostID(id uint32, mappings []vm.IDMap) int {
+	if len(mappings) == 0 {
+		return int(id)
+	}
+	for _, m := range mappings {
+		if id >= m.ContainerID && id-m.ContainerID < m.Size {
+			return int(m.HostID + id - m.ContainerID)
+		}
+	}
+	return overflowID
+}
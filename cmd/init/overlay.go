@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gotoz/runq/internal/fscopy"
+	"github.com/gotoz/runq/pkg/vm"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	overlayDir   = "/overlay"
+	overlayShare = overlayDir + "/share"
+	overlayLower = overlayDir + "/lower"
+	overlayRW    = overlayDir + "/rw"
+	overlayUpper = overlayRW + "/upper"
+	overlayWork  = overlayRW + "/work"
+	overlayImage = overlayDir + "/image"
+)
+
+// rootfsWriteback is set if changes of the rootfs overlay must be written
+// back to the host on shutdown.
+var rootfsWriteback func() error
+
+// setupRootfsOverlay mounts the rootfs share as lower layer and an overlayfs
+// at /rootfs. The upper layer is either on tmpfs or on a scratch disk.
+// The lower layer is read-only unless changes are written back. Volumes are
+// bind-mounted from the writable share, read-only volumes read-only.
+// With a pmem image the image is the lower layer and the share provides
+// volumes and kernel modules only.
+func setupRootfsOverlay(vmdata *vm.Data) error {
+	if err := mountInitShare("rootfs", overlayShare, vmdata); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(overlayLower, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount(overlayShare, overlayLower, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("overlay: bind mount lower layer failed: %w", err)
+	}
+	if !vmdata.RootfsWriteback {
+		if err := unix.Mount("", overlayLower, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("overlay: remount lower layer read-only failed: %w", err)
+		}
+	}
+	lower := overlayLower
+	binds := vmdata.Volumes
+	if vmdata.RootfsPmem != "" {
+		if err := mountPmemImage(vmdata.RootfsPmem); err != nil {
+			return err
+		}
+		lower = overlayImage
+		binds = append([]string{"/lib/modules"}, binds...)
+	}
+
+	if vmdata.RootfsOverlay == "tmpfs" {
+		mnt := vm.Mount{
+			Source: "tmpfs",
+			Target: overlayRW,
+			Fstype: "tmpfs",
+			Flags:  unix.MS_NOSUID | unix.MS_NODEV,
+			Data:   "mode=0755",
+		}
+		if err := mount(mnt); err != nil {
+			return err
+		}
+	} else {
+		if err := mountOverlayDisk(vmdata); err != nil {
+			return err
+		}
+		// A scratch disk starts empty.
+		for _, d := range []string{overlayUpper, overlayWork} {
+			if err := os.RemoveAll(d); err != nil {
+				return fmt.Errorf("overlay: cleanup %s failed: %w", d, err)
+			}
+		}
+	}
+	for _, d := range []string{overlayUpper, overlayWork} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := loadKernelModules("overlay", ""); err != nil {
+		return err
+	}
+	if err := checkFilesystemSupport("overlay"); err != nil {
+		return err
+	}
+	mnt := vm.Mount{
+		Source: "overlay",
+		Target: "/rootfs",
+		Fstype: "overlay",
+		Data:   fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, overlayUpper, overlayWork),
+	}
+	if err := mount(mnt); err != nil {
+		return err
+	}
+
+	// Volumes bypass the overlay.
+	for _, v := range binds {
+		if err := bindVolume(v, false); err != nil {
+			return err
+		}
+	}
+	for _, v := range vmdata.ReadonlyVolumes {
+		if err := bindVolume(v, true); err != nil {
+			return err
+		}
+	}
+
+	if vmdata.RootfsWriteback {
+		volumes := append(vmdata.Volumes, vmdata.ReadonlyVolumes...)
+		rootfsWriteback = func() error {
+			return writebackOverlay(volumes)
+		}
+	}
+	return nil
+}
+
+// bindVolume bind-mounts a volume from the rootfs share onto the overlay.
+func bindVolume(v string, readonly bool) error {
+	src := overlayShare + v
+	dst := "/rootfs" + v
+	fi, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := mkMountpoint(dst, fi.IsDir()); err != nil {
+		return fmt.Errorf("overlay: %w", err)
+	}
+	if err := unix.Mount(src, dst, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("overlay: bind mount %s failed: %v", v, err)
+	}
+	if readonly {
+		if err := unix.Mount("", dst, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("overlay: remount %s read-only failed: %v", v, err)
+		}
+	}
+	return nil
+}
+
+// mountOverlayDisk mounts the scratch disk of the upper layer and removes it
+// from the list of regular disks.
+func mountOverlayDisk(vmdata *vm.Data) error {
+	var disk vm.Disk
+	for i, d := range vmdata.Disks {
+		if d.ID == vmdata.RootfsOverlay {
+			disk = d
+			vmdata.Disks = append(vmdata.Disks[:i], vmdata.Disks[i+1:]...)
+			break
+		}
+	}
+
+	dev, err := findDisk(disk.Serial)
+	if err != nil {
+		return err
+	}
+	if dev == "" {
+		return fmt.Errorf("overlay disk %q not found", vmdata.RootfsOverlay)
+	}
+	if err := createDiskSymlink(dev, disk.ID); err != nil {
+		return err
+	}
+
+	fstype := disk.Fstype
+	if fstype == "auto" {
+		if fstype, err = detectFstype("/dev/" + dev); err != nil {
+			return fmt.Errorf("disk %s: %w", disk.ID, err)
+		}
+	}
+	if err := loadKernelModules(fstype, ""); err != nil {
+		return err
+	}
+	mnt := vm.Mount{
+		ID:     disk.ID,
+		Source: "/dev/" + dev,
+		Target: overlayRW,
+		Fstype: fstype,
+		Flags:  unix.MS_NOSUID | unix.MS_NODEV,
+	}
+	if err := mount(mnt); err != nil {
+		return err
+	}
+	diskInfos = append(diskInfos, vm.DiskInfo{
+		Device: dev,
+		Fstype: fstype,
+		ID:     disk.ID,
+		Path:   mnt.Target,
+	})
+	return nil
+}
+
+// mountPmemImage mounts the image of the read-only rootfs layers from the
+// virtio-pmem device. erofs is mounted with DAX if supported by the kernel.
+func mountPmemImage(fstype string) error {
+	if err := loadKernelModules("pmem", ""); err != nil {
+		return err
+	}
+	if err := loadKernelModules(fstype, ""); err != nil {
+		return err
+	}
+	if err := checkFilesystemSupport(fstype); err != nil {
+		return err
+	}
+
+	const dev = "/dev/pmem0"
+	for i := 0; ; i++ {
+		if _, err := os.Stat(dev); err == nil {
+			break
+		}
+		if i == 100 {
+			return fmt.Errorf("pmem device %s not found", dev)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mnt := vm.Mount{
+		Source: dev,
+		Target: overlayImage,
+		Fstype: fstype,
+		Flags:  unix.MS_RDONLY | unix.MS_NODEV,
+	}
+	if fstype == "erofs" {
+		mnt.Data = "dax=always"
+		if err := mount(mnt); err == nil {
+			return nil
+		}
+		log.Printf("erofs: DAX not supported, mounting without DAX")
+		mnt.Data = ""
+	}
+	return mount(mnt)
+}
+
+// mkMountpoint creates a missing mount point for a directory or a file.
+func mkMountpoint(path string, dir bool) error {
+	if _, err := os.Lstat(path); err == nil {
+		return nil
+	}
+	if dir {
+		return os.MkdirAll(path, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writebackOverlay applies the changes of the upper layer to the lower layer.
+// Volumes have been written directly and are skipped.
+func writebackOverlay(volumes []string) error {
+	exclude := []string{globEscape(vm.QemuMountPt)}
+	for _, v := range volumes {
+		exclude = append(exclude, globEscape(v))
+	}
+
+	var whiteouts, opaque []string
+	err := fscopy.Walk(overlayUpper, exclude, func(rel string, st *unix.Stat_t) error {
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFCHR:
+			if st.Rdev == 0 {
+				whiteouts = append(whiteouts, rel)
+			}
+		case unix.S_IFDIR:
+			buf := make([]byte, 1)
+			if n, err := unix.Lgetxattr(overlayUpper+rel, "trusted.overlay.opaque", buf); err == nil && n == 1 && buf[0] == 'y' {
+				opaque = append(opaque, rel)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Opaque directories replace the content of the lower directory.
+	for _, rel := range opaque {
+		names, err := readDirNames(overlayLower + rel)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if err := removeLower(filepath.Join(rel, n), volumes); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rel := range whiteouts {
+		if err := removeLower(rel, volumes); err != nil {
+			return err
+		}
+		exclude = append(exclude, globEscape(rel))
+	}
+
+	res, err := fscopy.Copy(overlayUpper, overlayLower, fscopy.Options{Exclude: exclude})
+	if err != nil {
+		return err
+	}
+	log.Printf("overlay writeback: %d files, %d bytes, %d deleted", res.Files, res.Bytes, len(whiteouts))
+	return nil
+}
+
+// removeLower removes a file or directory of the lower layer but never
+// removes volumes or their parent directories.
+func removeLower(rel string, volumes []string) error {
+	for _, v := range volumes {
+		if v == rel {
+			return nil
+		}
+		if strings.HasPrefix(v, rel+"/") {
+			names, err := readDirNames(overlayLower + rel)
+			if err != nil {
+				return err
+			}
+			for _, n := range names {
+				if err := removeLower(filepath.Join(rel, n), volumes); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if err := os.RemoveAll(overlayLower + rel); err != nil {
+		return fmt.Errorf("overlay writeback: %w", err)
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// globEscape returns an anchored exclude pattern that matches path literally.
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		switch r {
+		case '*', '?', '[', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
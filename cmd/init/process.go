@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/gotoz/runq/pkg/vm"
+	"golang.org/x/sys/unix"
+)
+
+// see linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioprioClasses = map[string]int{
+	"IOPRIO_CLASS_RT":   1,
+	"IOPRIO_CLASS_BE":   2,
+	"IOPRIO_CLASS_IDLE": 3,
+}
+
+var schedPolicies = map[string]uint32{
+	"SCHED_OTHER":    unix.SCHED_NORMAL,
+	"SCHED_FIFO":     unix.SCHED_FIFO,
+	"SCHED_RR":       unix.SCHED_RR,
+	"SCHED_BATCH":    unix.SCHED_BATCH,
+	"SCHED_IDLE":     unix.SCHED_IDLE,
+	"SCHED_DEADLINE": unix.SCHED_DEADLINE,
+}
+
+var schedFlags = map[string]uint64{
+	"SCHED_FLAG_RESET_ON_FORK":  unix.SCHED_FLAG_RESET_ON_FORK,
+	"SCHED_FLAG_RECLAIM":        unix.SCHED_FLAG_RECLAIM,
+	"SCHED_FLAG_DL_OVERRUN":     unix.SCHED_FLAG_DL_OVERRUN,
+	"SCHED_FLAG_KEEP_POLICY":    unix.SCHED_FLAG_KEEP_POLICY,
+	"SCHED_FLAG_KEEP_PARAMS":    unix.SCHED_FLAG_KEEP_PARAMS,
+	"SCHED_FLAG_UTIL_CLAMP_MIN": unix.SCHED_FLAG_UTIL_CLAMP_MIN,
+	"SCHED_FLAG_UTIL_CLAMP_MAX": unix.SCHED_FLAG_UTIL_CLAMP_MAX,
+}
+
+// see linux/personality.h
+var personalityDomains = map[string]uintptr{
+	"LINUX":   0x0000,
+	"LINUX32": 0x0008,
+}
+
+// setOOMScoreAdj sets the OOM score adjustment of the entrypoint.
+func setOOMScoreAdj(score *int) error {
+	if score == nil {
+		return nil
+	}
+	if *score < -1000 || *score > 1000 {
+		return fmt.Errorf("invalid oom score adj: %d", *score)
+	}
+	return os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(*score)), 0)
+}
+
+// setIOPriority sets the I/O scheduling class and priority of the entrypoint.
+func setIOPriority(prio *vm.IOPriority) error {
+	if prio == nil {
+		return nil
+	}
+	class, ok := ioprioClasses[prio.Class]
+	if !ok {
+		return fmt.Errorf("invalid io priority class: %s", prio.Class)
+	}
+	if prio.Priority < 0 || prio.Priority > 7 {
+		return fmt.Errorf("invalid io priority: %d", prio.Priority)
+	}
+	value := class<<ioprioClassShift | prio.Priority
+	if _, _, e1 := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(value)); e1 != 0 {
+		return fmt.Errorf("ioprio_set failed: %w", e1)
+	}
+	return nil
+}
+
+// setScheduler sets the scheduling policy and attributes of the entrypoint.
+func setScheduler(sched *vm.Scheduler) error {
+	if sched == nil {
+		return nil
+	}
+	policy, ok := schedPolicies[sched.Policy]
+	if !ok {
+		return fmt.Errorf("invalid scheduler policy: %s", sched.Policy)
+	}
+	attr := unix.SchedAttr{
+		Policy:   policy,
+		Nice:     sched.Nice,
+		Priority: uint32(sched.Priority),
+		Runtime:  sched.Runtime,
+		Deadline: sched.Deadline,
+		Period:   sched.Period,
+	}
+	for _, f := range sched.Flags {
+		flag, ok := schedFlags[f]
+		if !ok {
+			return fmt.Errorf("invalid scheduler flag: %s", f)
+		}
+		attr.Flags |= flag
+	}
+	if err := unix.SchedSetAttr(0, &attr, 0); err != nil {
+		return fmt.Errorf("sched_setattr failed: %w", err)
+	}
+	return nil
+}
+
+// setPersonality sets the execution domain of the entrypoint.
+func setPersonality(p *vm.Personality) error {
+	if p == nil {
+		return nil
+	}
+	domain, ok := personalityDomains[p.Domain]
+	if !ok {
+		return fmt.Errorf("invalid personality domain: %s", p.Domain)
+	}
+	// No flags are defined by the spec.
+	if len(p.Flags) > 0 {
+		return fmt.Errorf("personality flags are not supported: %v", p.Flags)
+	}
+	if _, _, e1 := unix.Syscall(unix.SYS_PERSONALITY, domain, 0, 0); e1 != 0 {
+		return fmt.Errorf("personality failed: %w", e1)
+	}
+	return nil
+}
@@ -14,7 +14,7 @@ func reaper() {
 		for {
 			wpid, err := unix.Wait4(-1, nil, unix.WNOHANG, nil)
 			if err != nil {
-				log.Printf("Wait failed: %w", err)
+				log.Printf("Wait failed: %v", err)
 				break
 			}
 			if wpid <= 0 { //  -1 Error, 0 no childs
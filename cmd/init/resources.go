@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/gotoz/runq/internal/cfg"
+	"github.com/gotoz/runq/internal/util"
+	"github.com/gotoz/runq/pkg/vm"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupFile is a cgroup control file and the value to write.
+type cgroupFile struct {
+	name  string
+	value string
+}
+
+// setCgroup2Resources applies the resource limits to the cgroup v2 directory dir.
+func setCgroup2Resources(dir string, res vm.Resources) error {
+	files := []cgroupFile{
+		{"memory.max", strconv.FormatInt(memoryLimit(res.MemoryLimit), 10)},
+	}
+	if res.PidsLimit > 0 {
+		files = append(files, cgroupFile{"pids.max", strconv.FormatInt(res.PidsLimit, 10)})
+	}
+	if res.CPUShares > 0 {
+		// Conversion from cpu.shares [2-262144] to cpu.weight [1-10000] as done by runc.
+		weight := 1 + ((res.CPUShares-2)*9999)/262142
+		files = append(files, cgroupFile{"cpu.weight", strconv.FormatUint(weight, 10)})
+	}
+	if res.CPUQuota != 0 || res.CPUPeriod != 0 {
+		quota := "max"
+		if res.CPUQuota > 0 {
+			quota = strconv.FormatInt(res.CPUQuota, 10)
+		}
+		period := res.CPUPeriod
+		if period == 0 {
+			period = 100000
+		}
+		files = append(files, cgroupFile{"cpu.max", fmt.Sprintf("%s %d", quota, period)})
+	}
+	if err := writeCgroupFiles(dir, files); err != nil {
+		return err
+	}
+	if len(res.Devices) > 0 {
+		return loadDeviceFilter(dir, res.Devices)
+	}
+	return nil
+}
+
+// setCgroup1Resources moves the entrypoint into a leaf cgroup of the cgroup v1
+// hierarchies mounted at /sys/fs/cgroup and applies the resource limits.
+func setCgroup1Resources(res vm.Resources) error {
+	const root = "/sys/fs/cgroup"
+	hierarchies := map[string][]cgroupFile{
+		"memory": {
+			{"memory.limit_in_bytes", strconv.FormatInt(memoryLimit(res.MemoryLimit), 10)},
+		},
+	}
+	if res.PidsLimit > 0 {
+		hierarchies["pids"] = []cgroupFile{{"pids.max", strconv.FormatInt(res.PidsLimit, 10)}}
+	}
+	var cpu []cgroupFile
+	if res.CPUShares > 0 {
+		cpu = append(cpu, cgroupFile{"cpu.shares", strconv.FormatUint(res.CPUShares, 10)})
+	}
+	if res.CPUPeriod > 0 {
+		cpu = append(cpu, cgroupFile{"cpu.cfs_period_us", strconv.FormatUint(res.CPUPeriod, 10)})
+	}
+	if res.CPUQuota != 0 {
+		cpu = append(cpu, cgroupFile{"cpu.cfs_quota_us", strconv.FormatInt(res.CPUQuota, 10)})
+	}
+	if len(cpu) > 0 {
+		hierarchies["cpu,cpuacct"] = cpu
+	}
+	if len(res.Devices) > 0 {
+		var devices []cgroupFile
+		for _, r := range res.Devices {
+			name := "devices.deny"
+			if r.Allow {
+				name = "devices.allow"
+			}
+			devices = append(devices, cgroupFile{name, deviceRuleV1(r)})
+		}
+		hierarchies["devices"] = devices
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	for h, files := range hierarchies {
+		dir := root + "/" + h
+		if !util.DirExists(dir) {
+			log.Printf("cgroup %s not available, resource limits ignored", h)
+			continue
+		}
+		leaf := dir + "/" + cgroupLeaf
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := writeCgroupFiles(leaf, files); err != nil {
+			return err
+		}
+		if err := os.WriteFile(leaf+"/cgroup.procs", []byte(pid), 0); err != nil {
+			return fmt.Errorf("move entrypoint into cgroup %s failed: %w", leaf, err)
+		}
+	}
+	return nil
+}
+
+// writeCgroupFiles writes the control files in dir. Files of controllers
+// that are not available are skipped.
+func writeCgroupFiles(dir string, files []cgroupFile) error {
+	for _, f := range files {
+		path := dir + "/" + f.name
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			log.Printf("cgroup file %s not available, %q ignored", path, f.value)
+			continue
+		}
+		if err := os.WriteFile(path, []byte(f.value), 0); err != nil {
+			return fmt.Errorf("write %q to %s failed: %w", f.value, path, err)
+		}
+	}
+	return nil
+}
+
+// memoryLimit returns the memory limit of the entrypoint in bytes. The limit
+// is capped by the VM memory minus a reserve for init and vsockd.
+func memoryLimit(limit int64) int64 {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return limit
+	}
+	max := int64(info.Totalram)*int64(info.Unit) - cfg.MemReserve<<20
+	if max <= 0 || (limit > 0 && limit < max) {
+		return limit
+	}
+	return max
+}
+
+// deviceRuleV1 formats a device rule for devices.allow and devices.deny.
+func deviceRuleV1(r vm.DeviceRule) string {
+	if r.Type == "a" {
+		return "a"
+	}
+	num := func(n int64) string {
+		if n == -1 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	access := r.Access
+	if access == "" {
+		access = "rwm"
+	}
+	return fmt.Sprintf("%s %s:%s %s", r.Type, num(r.Major), num(r.Minor), access)
+}
+
+// guestDeviceRules returns allow rules for the devices runq provides to the
+// entrypoint: disks without filesystem and the AP device. The device rules
+// of the spec refer to the devices of the host.
+func guestDeviceRules(apDevice bool) []vm.DeviceRule {
+	var paths []string
+	for _, d := range diskInfos {
+		if d.Fstype == "" {
+			paths = append(paths, "/dev/"+d.Device, "/dev/mapper/"+d.ID)
+		}
+	}
+	if apDevice {
+		paths = append(paths, "/dev/z90crypt")
+	}
+
+	var rules []vm.DeviceRule
+	for _, p := range paths {
+		var st unix.Stat_t
+		if err := unix.Stat(p, &st); err != nil {
+			continue
+		}
+		rule := vm.DeviceRule{
+			Access: "rwm",
+			Allow:  true,
+			Major:  int64(unix.Major(uint64(st.Rdev))),
+			Minor:  int64(unix.Minor(uint64(st.Rdev))),
+		}
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFBLK:
+			rule.Type = "b"
+		case unix.S_IFCHR:
+			rule.Type = "c"
+		default:
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -36,6 +36,10 @@ func canDoSeccomp() (bool, error) {
 	return res, nil
 }
 
+// seccompSocketFd is the socket to pass the seccomp notify file descriptor
+// of the entrypoint to init. Only present if the spec has a listener path.
+const seccompSocketFd = 4
+
 func initSeccomp(seccompGob []byte) error {
 	if len(seccompGob) == 0 {
 		// Filter can be empty via "--security-opt seccomp=unconfined"
@@ -56,7 +60,10 @@ func initSeccomp(seccompGob []byte) error {
 		return fmt.Errorf("dec.Decode LinuxSeccomp failed: %w", err)
 	}
 
-	defaultAction, err := convertAction(sec.DefaultAction)
+	if sec.DefaultAction == specs.ActNotify {
+		return errors.New("seccomp: SCMP_ACT_NOTIFY cannot be used as default action")
+	}
+	defaultAction, err := convertAction(sec.DefaultAction, sec.DefaultErrnoRet)
 	if err != nil {
 		return err
 	}
@@ -84,7 +91,22 @@ func initSeccomp(seccompGob []byte) error {
 		return fmt.Errorf("set no new privileges failed: %v", err)
 	}
 
+	for _, flag := range sec.Flags {
+		if err := setFlag(filter, flag); err != nil {
+			return err
+		}
+	}
+
+	var notify bool
 	for _, sc := range sec.Syscalls {
+		if sc.Action == specs.ActNotify {
+			notify = true
+		}
+		action, err := convertAction(sc.Action, sc.ErrnoRet)
+		if err != nil {
+			return err
+		}
+
 		for _, name := range sc.Names {
 			if name == "" {
 				return errors.New("empty syscall name")
@@ -97,19 +119,14 @@ func initSeccomp(seccompGob []byte) error {
 				continue
 			}
 
-			action, err := convertAction(sc.Action)
-			if err != nil {
-				return err
-			}
-
 			// The default errno for SCMP_ACT_ERRNO is EPERM which breaks the new
 			// syscall "clone3" used in latest glibc 2.34. ENOSYS is required for
-			// "clone3" to trigger the fallback to "clone". Unfortunately we don't get
-			// the errno from the OCI spec and therefore we have to set it manually
-			// for now. For details see
+			// "clone3" to trigger the fallback to "clone". Profiles without
+			// errnoRet get ENOSYS for "clone3". For details see
 			// https://github.com/moby/moby/issues/42680 and
 			// https://github.com/moby/moby/commit/9f6b562d
-			if name == "clone3" && sc.Action == "SCMP_ACT_ERRNO" {
+			action := action
+			if name == "clone3" && sc.Action == specs.ActErrno && sc.ErrnoRet == nil {
 				action = action.SetReturnCode(int16(syscall.ENOSYS))
 			}
 
@@ -138,25 +155,94 @@ func initSeccomp(seccompGob []byte) error {
 		}
 	}
 
+	if notify && sec.ListenerPath == "" {
+		return errors.New("seccomp: SCMP_ACT_NOTIFY requires a listener path")
+	}
+
 	if err = filter.Load(); err != nil {
 		return fmt.Errorf("error loading seccomp filter into kernel: %w", err)
 	}
+
+	if sec.ListenerPath == "" {
+		return nil
+	}
+	fd := -1
+	if notify {
+		nfd, err := filter.GetNotifFd()
+		if err != nil {
+			return fmt.Errorf("filter.GetNotifFd failed: %w", err)
+		}
+		fd = int(nfd)
+	}
+	return sendSeccompFd(fd)
+}
+
+// sendSeccompFd passes the seccomp notify file descriptor to init, -1 if
+// the filter has no notify rules. Both file descriptors are closed
+// afterwards and are not inherited by the entrypoint program.
+func sendSeccompFd(fd int) error {
+	defer unix.Close(seccompSocketFd)
+	var rights []byte
+	if fd != -1 {
+		defer unix.Close(fd)
+		rights = unix.UnixRights(fd)
+	}
+	if err := unix.Sendmsg(seccompSocketFd, []byte{0}, rights, nil, 0); err != nil {
+		return fmt.Errorf("send seccomp notify fd failed: %w", err)
+	}
+	return nil
+}
+
+// setFlag sets a seccomp flag of the spec. Same as in runc.
+func setFlag(filter *libseccomp.ScmpFilter, flag specs.LinuxSeccompFlag) error {
+	switch flag {
+	case "SECCOMP_FILTER_FLAG_TSYNC":
+		// libseccomp always synchronizes all threads.
+		return nil
+	case "SECCOMP_FILTER_FLAG_LOG":
+		if err := filter.SetLogBit(true); err != nil {
+			return fmt.Errorf("seccomp flag %s failed: %w", flag, err)
+		}
+	case "SECCOMP_FILTER_FLAG_SPEC_ALLOW":
+		if err := filter.SetSSB(true); err != nil {
+			return fmt.Errorf("seccomp flag %s failed: %w", flag, err)
+		}
+	default:
+		return fmt.Errorf("seccomp: flag %s is not supported", flag)
+	}
 	return nil
 }
 
 var actions = map[specs.LinuxSeccompAction]libseccomp.ScmpAction{
-	"SCMP_ACT_KILL":  libseccomp.ActKill,
-	"SCMP_ACT_ERRNO": libseccomp.ActErrno.SetReturnCode(int16(unix.EPERM)),
-	"SCMP_ACT_TRAP":  libseccomp.ActTrap,
-	"SCMP_ACT_ALLOW": libseccomp.ActAllow,
-	"SCMP_ACT_TRACE": libseccomp.ActTrace.SetReturnCode(int16(unix.EPERM)),
+	specs.ActKill:        libseccomp.ActKillThread,
+	specs.ActKillProcess: libseccomp.ActKillProcess,
+	specs.ActKillThread:  libseccomp.ActKillThread,
+	specs.ActErrno:       libseccomp.ActErrno,
+	specs.ActTrap:        libseccomp.ActTrap,
+	specs.ActAllow:       libseccomp.ActAllow,
+	specs.ActTrace:       libseccomp.ActTrace,
+	specs.ActLog:         libseccomp.ActLog,
+	specs.ActNotify:      libseccomp.ActNotify,
 }
 
-func convertAction(a specs.LinuxSeccompAction) (libseccomp.ScmpAction, error) {
+// convertAction converts a seccomp action of the spec. The return code of
+// SCMP_ACT_ERRNO and SCMP_ACT_TRACE is errnoRet or EPERM if not set.
+func convertAction(a specs.LinuxSeccompAction, errnoRet *uint) (libseccomp.ScmpAction, error) {
 	act, ok := actions[a]
 	if !ok {
 		return 0, fmt.Errorf("seccomp: invalid action %v", a)
 	}
+	switch a {
+	case specs.ActErrno, specs.ActTrace:
+		ret := int16(unix.EPERM)
+		if errnoRet != nil {
+			ret = int16(*errnoRet)
+		}
+		return act.SetReturnCode(ret), nil
+	}
+	if errnoRet != nil {
+		return 0, fmt.Errorf("seccomp: errnoRet is not supported for action %v", a)
+	}
 	return act, nil
 }
 
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gotoz/runq/pkg/vm"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"golang.org/x/sys/unix"
+)
+
+// The seccomp notify file descriptor of the entrypoint only exists inside
+// the VM and can't be passed to the seccomp agent on the host. Instead init
+// receives the notifications and forwards them as JSON lines via a virtio
+// serial port that is connected to the socket of the agent:
+//
+//	-> hello (seccompHello)
+//	-> notification (seccompNotif)
+//	<- response (libseccomp.ScmpNotifResp)
+//	...
+//
+// The protocol is documented in the README. Incompatible changes require
+// a new seccompAgentVersion.
+
+// seccompAgentVersion is the version of the protocol with the seccomp agent.
+const seccompAgentVersion = 1
+
+// seccompHello is the first message to the agent.
+type seccompHello struct {
+	Version int                         `json:"version"`
+	State   specs.ContainerProcessState `json:"state"` // without fds
+}
+
+// seccompNotif is a seccomp user notification as sent to the agent.
+type seccompNotif struct {
+	ID           uint64   `json:"id"`
+	Pid          uint32   `json:"pid"`
+	Flags        uint32   `json:"flags"`
+	Syscall      string   `json:"syscall"`
+	Arch         string   `json:"arch"`
+	InstrPointer uint64   `json:"instr_pointer"`
+	Args         []uint64 `json:"args"`
+}
+
+// newSeccompSocket returns a socket pair to receive the seccomp notify file
+// descriptor from the entrypoint.
+func newSeccompSocket() (*os.File, *os.File, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("socketpair failed: %w", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "seccomp"), os.NewFile(uintptr(fds[1]), "seccomp"), nil
+}
+
+// forwardSeccompNotifications receives the seccomp notify file descriptor
+// of the entrypoint and forwards its notifications to the seccomp agent.
+// If the agent fails, the file descriptor is closed and the pending and
+// following syscalls fail with ENOSYS.
+func forwardSeccompNotifications(sock *os.File, agent *vm.SeccompAgent, pid int) {
+	fd, err := recvSeccompFd(sock)
+	sock.Close()
+	if err != nil {
+		log.Printf("seccomp agent: %v", err)
+		return
+	}
+	if fd == -1 {
+		return
+	}
+	defer unix.Close(fd)
+
+	dev, err := vportDevice(vm.SeccompPort)
+	if err != nil {
+		log.Printf("seccomp agent: %v", err)
+		return
+	}
+	port, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		log.Printf("seccomp agent: %v", err)
+		return
+	}
+	defer port.Close()
+
+	hello := seccompHello{
+		Version: seccompAgentVersion,
+		State: specs.ContainerProcessState{
+			Version:  specs.Version,
+			Fds:      []string{},
+			Pid:      pid,
+			Metadata: agent.Metadata,
+		},
+	}
+	if err := json.Unmarshal(agent.State, &hello.State.State); err != nil {
+		log.Printf("seccomp agent: invalid state: %v", err)
+		return
+	}
+	hello.State.State.Pid = pid
+
+	enc := json.NewEncoder(port)
+	dec := json.NewDecoder(bufio.NewReader(port))
+	if err := enc.Encode(hello); err != nil {
+		log.Printf("seccomp agent: %v", err)
+		return
+	}
+
+	for {
+		req, err := libseccomp.NotifReceive(libseccomp.ScmpFd(fd))
+		if err != nil {
+			// The target process went away before the notification
+			// could be received.
+			if err == unix.ENOENT {
+				continue
+			}
+			log.Printf("seccomp agent: receive notification failed: %v", err)
+			return
+		}
+
+		name, _ := req.Data.Syscall.GetNameByArch(req.Data.Arch)
+		notif := seccompNotif{
+			ID:           req.ID,
+			Pid:          req.Pid,
+			Flags:        req.Flags,
+			Syscall:      name,
+			Arch:         specArch(req.Data.Arch),
+			InstrPointer: req.Data.InstrPointer,
+			Args:         req.Data.Args,
+		}
+		if err := enc.Encode(notif); err != nil {
+			log.Printf("seccomp agent: send notification failed: %v", err)
+			return
+		}
+		var resp libseccomp.ScmpNotifResp
+		if err := dec.Decode(&resp); err != nil {
+			log.Printf("seccomp agent: receive response failed: %v", err)
+			return
+		}
+		resp.ID = req.ID
+
+		// The process may have been killed in the meantime.
+		if libseccomp.NotifIDValid(libseccomp.ScmpFd(fd), req.ID) != nil {
+			continue
+		}
+		if err := libseccomp.NotifRespond(libseccomp.ScmpFd(fd), &resp); err != nil {
+			log.Printf("seccomp agent: respond failed: %v", err)
+		}
+	}
+}
+
+// recvSeccompFd receives the seccomp notify file descriptor from the
+// entrypoint. It returns -1 if the filter has no notify rules.
+func recvSeccompFd(sock *os.File) (int, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(int(sock.Fd()), buf, oob, unix.MSG_CMSG_CLOEXEC)
+	if err != nil {
+		return -1, fmt.Errorf("receive seccomp notify fd failed: %w", err)
+	}
+	// The entrypoint failed before the filter was loaded.
+	if n == 0 {
+		return -1, nil
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return -1, err
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return -1, fmt.Errorf("invalid seccomp notify fd: %v", err)
+	}
+	return fds[0], nil
+}
+
+// specArch returns the OCI name of a seccomp architecture.
+func specArch(arch libseccomp.ScmpArch) string {
+	for k, v := range archs {
+		if v == arch.String() {
+			return string(k)
+		}
+	}
+	return arch.String()
+}
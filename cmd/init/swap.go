@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	swapMagic   = "SWAPSPACE2"
+	swapMinSize = 10 // pages
+
+	// see linux/swap.h
+	swapFlagPrefer   = 0x8000
+	zramSwapPriority = 100
+)
+
+// setupSwap enables swap on a block device. A blank device is initialized
+// with a swap signature first. Devices that contain other data are rejected.
+// Priority -1 uses the kernel default.
+func setupSwap(dev string, priority int) error {
+	pagesize := os.Getpagesize()
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Superblocks of known filesystems are located within the first 128k.
+	buf := make([]byte, 128<<10)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("read %s failed: %w", dev, err)
+	}
+	buf = buf[:n]
+	switch {
+	case n >= pagesize && string(buf[pagesize-len(swapMagic):pagesize]) == swapMagic:
+	case isBlank(buf):
+		if err := mkswap(f, pagesize); err != nil {
+			return fmt.Errorf("mkswap %s failed: %w", dev, err)
+		}
+	default:
+		return fmt.Errorf("%s is neither blank nor swap space", dev)
+	}
+	return swapon(dev, priority)
+}
+
+func isBlank(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mkswap writes a version 1 swap header, see union swap_header in linux/swap.h.
+func mkswap(f *os.File, pagesize int) error {
+	var size int64
+	if _, _, e := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); e != 0 {
+		return e
+	}
+	pages := size / int64(pagesize)
+	if pages < swapMinSize {
+		return fmt.Errorf("device too small")
+	}
+	if pages-1 > 0xffffffff {
+		pages = 0xffffffff + 1
+	}
+
+	// The header is read in native byte order.
+	hdr := make([]byte, pagesize)
+	binary.NativeEndian.PutUint32(hdr[1024:], 1)               // version
+	binary.NativeEndian.PutUint32(hdr[1028:], uint32(pages-1)) // last_page
+	binary.NativeEndian.PutUint32(hdr[1032:], 0)               // nr_badpages
+	uuid := hdr[1036 : 1036+16]                                // sws_uuid
+	if _, err := rand.Read(uuid); err != nil {
+		return err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	copy(hdr[pagesize-len(swapMagic):], swapMagic)
+
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func swapon(dev string, priority int) error {
+	p, err := unix.BytePtrFromString(dev)
+	if err != nil {
+		return err
+	}
+	var flags uintptr
+	if priority >= 0 {
+		flags = swapFlagPrefer | uintptr(priority)
+	}
+	if _, _, e := unix.Syscall(unix.SYS_SWAPON, uintptr(unsafe.Pointer(p)), flags, 0); e != 0 {
+		return fmt.Errorf("swapon %s failed: %w", dev, e)
+	}
+	return nil
+}
+
+// setupZram creates a compressed swap device in memory.
+func setupZram(size int64) error {
+	if err := loadKernelModules("zram", "/rootfs"); err != nil {
+		return err
+	}
+	if _, err := os.Stat("/sys/block/zram0"); err != nil {
+		return fmt.Errorf("zram is not supported by the kernel")
+	}
+	if err := os.WriteFile("/sys/block/zram0/disksize", []byte(strconv.FormatInt(size, 10)), 0); err != nil {
+		return fmt.Errorf("set zram size failed: %w", err)
+	}
+	return setupSwap("/dev/zram0", zramSwapPriority)
+}
@@ -5,54 +5,106 @@
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
+#include <sys/stat.h>
 #include <sys/types.h>
 #include <sys/wait.h>
+#include <grp.h>
 #include <unistd.h>
 
-int nsenter(pid_t nspid)
+#ifndef CLONE_NEWTIME
+#define CLONE_NEWTIME 0x00000080
+#endif
+
+// join_ns joins the namespace of type nstype of process nspid if it differs
+// from the namespace of the caller. Returns 1 if the namespace was joined.
+int join_ns(pid_t nspid, const char *name, int nstype)
 {
-	char ns_ipc[64];
-	char ns_mnt[64];
-	char ns_pid[64];
-	char root[64];
-	int fd_ipc, fd_mnt, fd_pid, fd_root;
+	char self[64], path[64];
+	struct stat st_self, st_ns;
+	int fd;
 
-	sprintf(ns_ipc, "/proc/%d/ns/ipc", nspid);
-	sprintf(ns_mnt, "/proc/%d/ns/mnt", nspid);
-	sprintf(ns_pid, "/proc/%d/ns/pid", nspid);
-	sprintf(root, "/proc/%d/root", nspid);
+	sprintf(self, "/proc/self/ns/%s", name);
+	sprintf(path, "/proc/%d/ns/%s", nspid, name);
 
-	fd_ipc = open(ns_ipc, O_RDONLY);
-	if (fd_ipc == -1) {
-		fprintf(stderr, "failed to open %s: %s\n", ns_ipc, strerror(errno));
+	if (stat(path, &st_ns) == -1) {
+		// namespace type not supported by the kernel
+		if (errno == ENOENT && stat(self, &st_self) == -1) {
+			return 0;
+		}
+		fprintf(stderr, "failed to stat %s: %s\n", path, strerror(errno));
+		return -1;
+	}
+	if (stat(self, &st_self) == -1) {
+		fprintf(stderr, "failed to stat %s: %s\n", self, strerror(errno));
 		return -1;
 	}
-	fd_mnt = open(ns_mnt, O_RDONLY);
-	if (fd_mnt == -1) {
-		fprintf(stderr, "failed to open %s: %s\n", ns_mnt, strerror(errno));
+	if (st_self.st_dev == st_ns.st_dev && st_self.st_ino == st_ns.st_ino) {
+		return 0;
+	}
+
+	fd = open(path, O_RDONLY);
+	if (fd == -1) {
+		fprintf(stderr, "failed to open %s: %s\n", path, strerror(errno));
 		return -1;
 	}
-	fd_pid = open(ns_pid, O_RDONLY);
-	if (fd_pid == -1) {
-		fprintf(stderr, "failed to open %s: %s\n", ns_pid, strerror(errno));
+	if (setns(fd, nstype) == -1) {
+		fprintf(stderr, "setns %s failed: %s\n", name, strerror(errno));
+		close(fd);
 		return -1;
 	}
+	close(fd);
+	return 1;
+}
+
+int nsenter(pid_t nspid)
+{
+	char root[64];
+	int fd_root, userns;
+
+	sprintf(root, "/proc/%d/root", nspid);
 	fd_root = open(root, O_RDONLY);
 	if (fd_root == -1) {
 		fprintf(stderr, "failed to open %s: %s\n", root, strerror(errno));
 		return -1;
 	}
 
-	if (setns(fd_ipc, CLONE_NEWIPC) == -1) {
-		perror("setns ipc failed");
+	// All namespaces except the mount namespace are owned by the initial
+	// user namespace and must be joined before the user namespace.
+	if (join_ns(nspid, "ipc", CLONE_NEWIPC) == -1) {
+		return -1;
+	}
+	if (join_ns(nspid, "uts", CLONE_NEWUTS) == -1) {
+		return -1;
+	}
+	if (join_ns(nspid, "cgroup", CLONE_NEWCGROUP) == -1) {
+		return -1;
+	}
+	if (join_ns(nspid, "time", CLONE_NEWTIME) == -1) {
+		return -1;
+	}
+	if (join_ns(nspid, "pid", CLONE_NEWPID) == -1) {
 		return -1;
 	}
-	if (setns(fd_mnt, CLONE_NEWNS) == -1) {
-		perror("setns mnt failed");
+	userns = join_ns(nspid, "user", CLONE_NEWUSER);
+	if (userns == -1) {
 		return -1;
 	}
-	if (setns(fd_pid, CLONE_NEWPID) == -1) {
-		perror("setns pid failed");
+	if (userns) {
+		// become root of the user namespace
+		if (setgroups(0, NULL) == -1) {
+			perror("setgroups failed");
+			return -1;
+		}
+		if (setresgid(0, 0, 0) == -1) {
+			perror("setresgid failed");
+			return -1;
+		}
+		if (setresuid(0, 0, 0) == -1) {
+			perror("setresuid failed");
+			return -1;
+		}
+	}
+	if (join_ns(nspid, "mnt", CLONE_NEWNS) == -1) {
 		return -1;
 	}
 	if (fchdir(fd_root) == -1) {
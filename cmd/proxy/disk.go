@@ -2,15 +2,23 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gotoz/runq/internal/fscopy"
 	"github.com/gotoz/runq/internal/loopback"
+	"github.com/gotoz/runq/internal/nbd"
 	"github.com/gotoz/runq/internal/util"
 	"github.com/gotoz/runq/pkg/vm"
 	"golang.org/x/sys/unix"
@@ -82,8 +90,13 @@ func updateDisks(disks []vm.Disk) error {
 		}
 
 		switch f[4] {
-		case "", "ext2", "ext3", "ext4", "xfs", "btrfs":
+		case "", "auto", "ext2", "ext3", "ext4", "xfs", "btrfs", "vfat", "f2fs", "squashfs":
 			d.Fstype = f[4]
+		case "swap":
+			if f[5] != "" {
+				return fmt.Errorf("swap disk must not have a mount point: %s", d.Path)
+			}
+			d.Swap = true
 		default:
 			return fmt.Errorf("unsupported filesystem '%s' in %s", f[4], d.Path)
 		}
@@ -117,11 +130,221 @@ func updateDisks(disks []vm.Disk) error {
 	return nil
 }
 
+// checkOverlayDisk verifies the disk used as upper layer of the rootfs overlay.
+// The disk must have a filesystem but no mount point.
+func checkOverlayDisk(vmdata *vm.Data) error {
+	if vmdata.RootfsOverlay == "" || vmdata.RootfsOverlay == "tmpfs" {
+		return nil
+	}
+	for _, d := range vmdata.Disks {
+		if d.ID != vmdata.RootfsOverlay {
+			continue
+		}
+		if d.Fstype == "" || d.Fstype == "squashfs" || d.Mount || d.Swap {
+			return fmt.Errorf("env RUNQ_ROOTFS_OVERLAY: disk %q needs a writable filesystem and no mount point", d.ID)
+		}
+		return nil
+	}
+	return fmt.Errorf("env RUNQ_ROOTFS_OVERLAY: invalid value %q, want tmpfs or a disk ID", vmdata.RootfsOverlay)
+}
+
+// maxDiskKeySize is the maximum size of a disk key or passphrase.
+const maxDiskKeySize = 8192
+
+// readDiskKeys reads the keys of encrypted disks from the files or unix
+// sockets that have been bind-mounted by runq. The bind mounts are removed
+// afterwards. Keys are sent to init only via the vmdata message.
+func readDiskKeys(disks []vm.Disk) error {
+	for i, d := range disks {
+		if d.Crypt == "" {
+			continue
+		}
+		path := filepath.Join(vm.DiskKeyDir, d.ID)
+		key, err := readDiskKey(path)
+		if err != nil {
+			return fmt.Errorf("disk %s: read key failed: %w", d.ID, err)
+		}
+		if len(key) == 0 {
+			return fmt.Errorf("disk %s: key is empty", d.ID)
+		}
+		disks[i].Key = key
+
+		if err := unix.Unmount(path, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("umount %s failed: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if util.DirExists(vm.DiskKeyDir) {
+		return os.Remove(vm.DiskKeyDir)
+	}
+	return nil
+}
+
+func readDiskKey(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	if fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		r = conn
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	key, err := io.ReadAll(io.LimitReader(r, maxDiskKeySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > maxDiskKeySize {
+		return nil, fmt.Errorf("key exceeds %d bytes", maxDiskKeySize)
+	}
+	return key, nil
+}
+
+const (
+	rootdiskID         = "rootdisk"
+	rootdiskPath       = "/dev/runq-rootdisk"
+	defaultRootdiskDir = "/.runq-rootdisk"
+)
+
+// rootdiskFilesystems lists the filesystems supported for rootdisks
+// with the command to create a new filesystem and a filesystem check.
+var rootdiskFilesystems = map[string]struct {
+	mkfs  []string
+	check func(dev string) error
+}{
+	"ext2":  {[]string{"/usr/sbin/mkfs.ext2", "-q", "-F"}, checkExtfs},
+	"ext4":  {[]string{"/usr/sbin/mkfs.ext4", "-q", "-F"}, checkExtfs},
+	"xfs":   {[]string{"/usr/sbin/mkfs.xfs", "-q", "-f"}, checkXfs},
+	"btrfs": {[]string{"/usr/bin/mkfs.btrfs", "-q", "-f"}, checkBtrfs},
+}
+
+// createRootdisk creates a sparse raw file or a qcow2 image of
+// vmdata.RootdiskSize bytes in vmdata.RootdiskDir and adds it as rootdisk
+// to the VM. An existing disk is reused. The file is bind-mounted to
+// /dev/runq-rootdisk because /rootfs is unmounted before Qemu starts.
+func createRootdisk(vmdata *vm.Data) error {
+	for _, d := range vmdata.Disks {
+		if d.ID == vmdata.Rootdisk {
+			return fmt.Errorf("rootdisk: disk ID %q is reserved", d.ID)
+		}
+	}
+
+	dir := filepath.Join("/rootfs", vmdata.RootdiskDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("rootdisk: %w", err)
+	}
+
+	dtype := vm.RawFile
+	path := filepath.Join(dir, "rootdisk.img")
+	if vmdata.RootdiskFormat == "qcow2" {
+		dtype = vm.Qcow2Image
+		path = filepath.Join(dir, "rootdisk.qcow2")
+	}
+
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if dtype == vm.RawFile && fi.Size() != vmdata.RootdiskSize {
+			log.Printf("rootdisk: reusing %s with size %d", vmdata.RootdiskDir, fi.Size())
+		}
+	case os.IsNotExist(err):
+		if err := mkRootdisk(path, dtype, vmdata.RootdiskSize, vmdata.RootdiskFstype); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("rootdisk: %w", err)
+		}
+	default:
+		return fmt.Errorf("rootdisk: %w", err)
+	}
+
+	f, err := os.OpenFile(rootdiskPath, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("rootdisk: %w", err)
+	}
+	f.Close()
+	if err := unix.Mount(path, rootdiskPath, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("rootdisk: bind mount %s failed: %w", path, err)
+	}
+
+	vmdata.Disks = append(vmdata.Disks, vm.Disk{
+		Cache:  "writeback",
+		Fstype: vmdata.RootdiskFstype,
+		ID:     vmdata.Rootdisk,
+		Path:   rootdiskPath,
+		Serial: util.RandStr(12),
+		Type:   dtype,
+	})
+	vmdata.RootdiskExclude = append(vmdata.RootdiskExclude, vmdata.RootdiskDir)
+	return nil
+}
+
+// mkRootdisk creates a new disk image with an empty filesystem.
+func mkRootdisk(path string, dtype vm.Disktype, size int64, fstype string) (err error) {
+	fs, ok := rootdiskFilesystems[fstype]
+	if !ok {
+		return fmt.Errorf("fstype %q is not supported", fstype)
+	}
+
+	dev := path
+	if dtype == vm.Qcow2Image {
+		cmd := exec.Command("/usr/bin/qemu-img", "create", "-q", "-f", "qcow2", path, strconv.FormatInt(size, 10))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("qemu-img failed: %v %s", err, out)
+		}
+		n, err := nbd.New()
+		if err != nil {
+			return err
+		}
+		if err := n.Connect(path, "qcow2"); err != nil {
+			return err
+		}
+		// The image stays locked until qemu-nbd has exited.
+		defer func() {
+			if e := n.Disconnect(); e != nil && err == nil {
+				err = e
+			}
+		}()
+		dev = n.Name
+	} else {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(size)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	args := append(append([]string{}, fs.mkfs...), dev)
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v %s", filepath.Base(args[0]), err, out)
+	}
+	return nil
+}
+
 // prepareRootdisk copies the content of the container root directory into a
-// bootdisk. The disk must have an empty ext2 or ext4 filesystem.
+// bootdisk. The disk must have an empty ext2, ext4, xfs or btrfs filesystem.
+// Raw files are attached via a loop device, qcow2 images via a network block device.
 // prepareRootdisk must run after pivot_root to /.qemu.mnt so that the container
 // files are in /.qemu.mnt/rootfs.
-func prepareRootdisk(vmdata *vm.Data) error {
+func prepareRootdisk(vmdata *vm.Data) (err error) {
 	var disk *vm.Disk
 	for _, d := range vmdata.Disks {
 		if d.ID == vmdata.Rootdisk {
@@ -133,43 +356,31 @@ func prepareRootdisk(vmdata *vm.Data) error {
 		return fmt.Errorf("rootdisk %q not found", vmdata.Rootdisk)
 	}
 
+	fs, ok := rootdiskFilesystems[disk.Fstype]
+	if !ok {
+		return fmt.Errorf("rootdisk: fstype %q is not supported, use ext2, ext4, xfs or btrfs", disk.Fstype)
+	}
+
 	dtype, err := disktype(disk.Path)
 	if err != nil {
 		return err
 	}
-	if dtype != vm.BlockDevice && dtype != vm.RawFile {
-		return fmt.Errorf("rootdisk %s: unsupported disktype", disk.Path)
-	}
 
 	excl := []string{"/dev", "/lib/modules", "/lost+found", "/proc", vm.QemuMountPt, "/sys"}
 	excl = append(excl, vmdata.RootdiskExclude...)
 
-	if disk.Fstype != "ext2" && disk.Fstype != "ext4" {
-		return fmt.Errorf("rootdisk: fstype %q is not supported, use ext2 or ext4", disk.Fstype)
-	}
-
-	cmd := exec.Command("/sbin/e2fsck", "-pv", disk.Path)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		rc, _ := util.ErrorToRc(err)
-		if rc > 0 {
-			log.Println(string(out))
-		}
-		if rc > 1 {
-			return fmt.Errorf("e2fsck failed: %v", err)
-		}
-	}
-
-	src := "/rootfs"
-	dest := "/dev/rootdisk"
-	if err := os.Mkdir(dest, 0700); err != nil {
-		return err
-	}
-
-	if dtype == vm.RawFile {
+	var dev string
+	switch dtype {
+	case vm.BlockDevice:
+		dev = disk.Path
+	case vm.RawFile:
 		loop, err := loopback.New()
 		if err != nil {
 			return err
 		}
+		// Release the device even if the proxy dies before Detach.
+		loop.Autoclear = true
+		loop.DirectIO = true
 
 		file, err := os.OpenFile(disk.Path, os.O_RDWR, 0600)
 		if err != nil {
@@ -181,18 +392,43 @@ func prepareRootdisk(vmdata *vm.Data) error {
 			return err
 		}
 		defer loop.Detach()
-
-		if err := unix.Mount(loop.Name, dest, disk.Fstype, 0, ""); err != nil {
-			return fmt.Errorf("mount loopback failed: %v", err)
+		dev = loop.Name
+	case vm.Qcow2Image:
+		n, err := nbd.New()
+		if err != nil {
+			return err
 		}
-	} else {
-		if err := unix.Mount(disk.Path, dest, disk.Fstype, 0, ""); err != nil {
-			return fmt.Errorf("mount rootdisk failed: %v", err)
+		if err := n.Connect(disk.Path, "qcow2"); err != nil {
+			return err
 		}
+		defer func() {
+			if e := n.Disconnect(); e != nil && err == nil {
+				err = e
+			}
+		}()
+		dev = n.Name
+	default:
+		return fmt.Errorf("rootdisk %s: unsupported disktype", disk.Path)
+	}
+
+	if err := fs.check(dev); err != nil {
+		return fmt.Errorf("rootdisk %s: %w", disk.Path, err)
 	}
 
+	src := "/rootfs"
+	dest := "/dev/rootdisk"
+	if err := os.Mkdir(dest, 0700); err != nil {
+		return err
+	}
+
+	if err := unix.Mount(dev, dest, disk.Fstype, 0, ""); err != nil {
+		return fmt.Errorf("mount rootdisk failed: %v", err)
+	}
+
+	// No lazy unmount: the filesystem must be written back completely
+	// before the loop or network block device is released.
 	defer func() {
-		if err := unix.Unmount(dest, unix.MNT_DETACH); err != nil {
+		if err := unix.Unmount(dest, 0); err != nil {
 			log.Printf("umount rootdisk failed: %v", err)
 		}
 		_ = os.Remove(dest)
@@ -203,38 +439,147 @@ func prepareRootdisk(vmdata *vm.Data) error {
 		return err
 	}
 
-	args := []string{"/usr/bin/rsync", "-aRH"}
+	opts := fscopy.Options{
+		DryRun:   vmdata.RootdiskDryRun,
+		Progress: progressLogger("rootdisk"),
+	}
 	if diskIsEmpty {
-		// new empty root disk, sync everything except explicitly excluded files
-		for _, d := range excl {
-			args = append(args, "--exclude", d)
-		}
-		args = append(args, "./")
+		// new empty root disk, copy everything except explicitly excluded files
+		opts.Exclude = excl
 	} else {
-		// reuse existing rootdisk, sync only files managed by Docker
-		args = append(args, "./etc/hosts", "./etc/hostname", "./etc/resolv.conf")
+		// reuse existing rootdisk, copy only files managed by Docker
+		opts.Paths = dockerFiles
+		if vmdata.RootdiskSync == "image" && !opts.DryRun {
+			if err := syncImage(src, dest, excl); err != nil {
+				return fmt.Errorf("rootdisk sync failed: %w", err)
+			}
+		}
+	}
+	res, err := fscopy.Copy(src, dest, opts)
+	if err != nil {
+		return fmt.Errorf("copy rootfs to rootdisk failed: %w", err)
+	}
+	if opts.DryRun {
+		for _, c := range res.Changes {
+			log.Printf("rootdisk: %s", c)
+		}
+		return fmt.Errorf("rootdisk: dry run, %d changes", len(res.Changes))
+	}
+	log.Printf("rootdisk: copied %d files, %d bytes", res.Files, res.Bytes)
+
+	if diskIsEmpty && vmdata.RootdiskSync == "image" {
+		if err := writeInitialManifest(src, dest, excl); err != nil {
+			return fmt.Errorf("rootdisk manifest failed: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll("/lib/modules", 0755); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readSuperblock reads size bytes at offset off of a device.
+func readSuperblock(dev string, off int64, size int) ([]byte, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sb := make([]byte, size)
+	if _, err := f.ReadAt(sb, off); err != nil {
+		return nil, fmt.Errorf("read superblock failed: %w", err)
+	}
+	return sb, nil
+}
+
+// checkExtfs verifies the superblock of an ext2/3/4 filesystem. Filesystems
+// that are marked with errors are rejected. A missing clean flag is only
+// reported because the kernel replays the journal on mount.
+func checkExtfs(dev string) error {
+	sb, err := readSuperblock(dev, 1024, 1024)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint16(sb[56:]) != 0xEF53 {
+		return fmt.Errorf("no ext2/3/4 filesystem found")
+	}
+	state := binary.LittleEndian.Uint16(sb[58:])
+	if state&0x2 != 0 {
+		return fmt.Errorf("filesystem has errors, run e2fsck")
+	}
+	if state&0x1 == 0 {
+		log.Printf("%s: filesystem was not cleanly unmounted", dev)
 	}
-	args = append(args, dest)
+	return nil
+}
 
-	if err := os.Chdir(src); err != nil {
-		return fmt.Errorf("chdir to %s failed: %v ", src, err)
+// checkXfs verifies the superblock of a xfs filesystem and runs xfs_repair.
+// Filesystems that were not completely created by mkfs are rejected.
+func checkXfs(dev string) error {
+	sb, err := readSuperblock(dev, 0, 512)
+	if err != nil {
+		return err
+	}
+	if string(sb[0:4]) != "XFSB" {
+		return fmt.Errorf("no xfs filesystem found")
+	}
+	if sb[126] != 0 { // sb_inprogress
+		return fmt.Errorf("filesystem is incomplete, run mkfs.xfs")
 	}
-	defer os.Chdir("/")
 
-	cmd = exec.Command(args[0], args[1:]...)
+	cmd := exec.Command("/usr/sbin/xfs_repair", dev)
 	if out, err := cmd.CombinedOutput(); err != nil {
-		rc, msg := util.ErrorToRc(err)
-		if rc > 0 {
-			log.Println(string(out))
-			return fmt.Errorf("rsync failed: %v rc=%d %s", err, rc, msg)
+		rc, _ := util.ErrorToRc(err)
+		log.Println(string(out))
+		// 2: the log must be replayed, the kernel does so on mount
+		if rc != 2 {
+			return fmt.Errorf("xfs_repair failed: %v", err)
 		}
 	}
-	if err := os.MkdirAll("/lib/modules", 0755); err != nil {
+	return nil
+}
+
+// checkBtrfs verifies the superblock of a btrfs filesystem and runs a
+// read-only btrfs check. btrfs has no safe automatic repair, filesystems
+// with errors are rejected.
+func checkBtrfs(dev string) error {
+	sb, err := readSuperblock(dev, 0x10000, 4096)
+	if err != nil {
 		return err
 	}
+	if string(sb[0x40:0x48]) != "_BHRfS_M" {
+		return fmt.Errorf("no btrfs filesystem found")
+	}
+	const flagError = 1 << 2
+	if binary.LittleEndian.Uint64(sb[0x38:])&flagError != 0 {
+		return fmt.Errorf("filesystem has errors, run btrfs check")
+	}
+
+	cmd := exec.Command("/usr/bin/btrfs", "check", "--readonly", dev)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Println(string(out))
+		return fmt.Errorf("btrfs check failed: %v", err)
+	}
 	return nil
 }
 
+// progressLogger returns a fscopy progress function that logs at most
+// every 10 seconds.
+func progressLogger(prefix string) func(fscopy.Progress) {
+	var mu sync.Mutex
+	last := time.Now()
+	return func(p fscopy.Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(last) < 10*time.Second {
+			return
+		}
+		last = time.Now()
+		log.Printf("%s: %d files, %d bytes copied", prefix, p.Files, p.Bytes)
+	}
+}
+
 func dirIsEmpty(name string) (bool, error) {
 	f, err := os.Open(name)
 	if err != nil {
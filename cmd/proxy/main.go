@@ -88,9 +88,11 @@ func run(vmdataB64 string) (int, error) {
 	//   /lib/modules will be bind-mounted to /rootfs/lib/modules.
 	//   /rootfs will be shared via 9p to the VM.
 	// - with rootdisk:
+	//   A rootdisk requested by size is created in /rootfs/<RootdiskDir> first.
 	//   The content of /rootfs will be copied into a block device.
 	//   /lib/modules will be bind-mounted to /share
 	//   /share will be shared via 9p to the VM.
+	// With RUNQ_SHARE=virtiofs the share is provided by virtiofsd instead of 9p.
 	var share, modulesMountDir string
 	if vmdata.Rootdisk == "" {
 		// w/o rootdisk
@@ -98,6 +100,11 @@ func run(vmdataB64 string) (int, error) {
 		modulesMountDir = "/rootfs/lib/modules"
 	} else {
 		// with rootdisk
+		if vmdata.RootdiskSize > 0 {
+			if err := createRootdisk(vmdata); err != nil {
+				return 1, err
+			}
+		}
 		if err := prepareRootdisk(vmdata); err != nil {
 			return 1, err
 		}
@@ -112,6 +119,12 @@ func run(vmdataB64 string) (int, error) {
 		return 1, err
 	}
 
+	if vmdata.Share == "virtiofs" {
+		if err = startVirtiofsd(share); err != nil {
+			return 1, err
+		}
+	}
+
 	// ackChan receives acknowledge messages from init.
 	// msgChan to send messages to init.
 	const vmsocket = "/dev/runq.sock"
@@ -286,6 +299,70 @@ func completeVmdata(vmdata *vm.Data) error {
 	if ok {
 		vmdata.Rootdisk = val
 	}
+	val, ok = os.LookupEnv("RUNQ_ROOTDISK_SIZE")
+	if ok {
+		if vmdata.Rootdisk != "" {
+			return fmt.Errorf("env RUNQ_ROOTDISK and RUNQ_ROOTDISK_SIZE are mutually exclusive")
+		}
+		if vmdata.RootdiskSize, err = util.ParseSize(val); err != nil {
+			return fmt.Errorf("env RUNQ_ROOTDISK_SIZE: %w", err)
+		}
+		vmdata.Rootdisk = rootdiskID
+		vmdata.RootdiskDir = defaultRootdiskDir
+		if val, ok = os.LookupEnv("RUNQ_ROOTDISK_DIR"); ok {
+			if !filepath.IsAbs(val) || filepath.Clean(val) == "/" {
+				return fmt.Errorf("env RUNQ_ROOTDISK_DIR: invalid directory %q", val)
+			}
+			vmdata.RootdiskDir = filepath.Clean(val)
+		}
+		vmdata.RootdiskFstype = "ext4"
+		if val, ok = os.LookupEnv("RUNQ_ROOTDISK_FSTYPE"); ok {
+			if _, ok := rootdiskFilesystems[val]; !ok {
+				return fmt.Errorf("env RUNQ_ROOTDISK_FSTYPE: invalid value %q, want (ext2|ext4|xfs|btrfs)", val)
+			}
+			vmdata.RootdiskFstype = val
+		}
+		vmdata.RootdiskFormat = "raw"
+		if val, ok = os.LookupEnv("RUNQ_ROOTDISK_FORMAT"); ok {
+			switch val {
+			case "raw", "qcow2":
+				vmdata.RootdiskFormat = val
+			default:
+				return fmt.Errorf("env RUNQ_ROOTDISK_FORMAT: invalid value %q, want (raw|qcow2)", val)
+			}
+		}
+	}
+	if val, ok = os.LookupEnv("RUNQ_ROOTDISK_SYNC"); ok {
+		switch val {
+		case "", "docker":
+		case "image":
+			vmdata.RootdiskSync = val
+		default:
+			return fmt.Errorf("env RUNQ_ROOTDISK_SYNC: invalid value %q, want (docker|image)", val)
+		}
+	}
+	if val, ok = os.LookupEnv("RUNQ_ROOTFS_OVERLAY"); ok && val != "" {
+		if vmdata.Rootdisk != "" {
+			return fmt.Errorf("env RUNQ_ROOTFS_OVERLAY can't be combined with a rootdisk")
+		}
+		vmdata.RootfsOverlay = val
+		vmdata.RootfsWriteback = util.ToBool(os.Getenv("RUNQ_ROOTFS_WRITEBACK"))
+	}
+	// RUNQ_ROOTFS_PMEM is handled by runq. The image of the read-only layers
+	// becomes the lower layer of the rootfs overlay.
+	if vmdata.RootfsPmem != "" {
+		switch {
+		case runtime.GOARCH != "amd64":
+			return fmt.Errorf("env RUNQ_ROOTFS_PMEM: not supported on %s", runtime.GOARCH)
+		case vmdata.Rootdisk != "":
+			return fmt.Errorf("env RUNQ_ROOTFS_PMEM can't be combined with a rootdisk")
+		case vmdata.RootfsWriteback:
+			return fmt.Errorf("env RUNQ_ROOTFS_PMEM can't be combined with RUNQ_ROOTFS_WRITEBACK")
+		}
+		if vmdata.RootfsOverlay == "" {
+			vmdata.RootfsOverlay = "tmpfs"
+		}
+	}
 	val, ok = os.LookupEnv("RUNQ_ROOTDISK_EXCLUDE")
 	if ok {
 		for _, v := range strings.Split(val, ",") {
@@ -296,6 +373,13 @@ func completeVmdata(vmdata *vm.Data) error {
 			vmdata.RootdiskExclude = append(vmdata.RootdiskExclude, v)
 		}
 	}
+	vmdata.RootdiskDryRun = util.ToBool(os.Getenv("RUNQ_ROOTDISK_DRYRUN"))
+
+	if val, ok = os.LookupEnv("RUNQ_ZRAM"); ok {
+		if vmdata.Zram, err = util.ParseSize(val); err != nil {
+			return fmt.Errorf("env RUNQ_ZRAM: %w", err)
+		}
+	}
 
 	vmdata.Networks, err = setupNetwork()
 	if err != nil {
@@ -305,6 +389,20 @@ func completeVmdata(vmdata *vm.Data) error {
 	if err := updateDisks(vmdata.Disks); err != nil {
 		return err
 	}
+	for _, d := range vmdata.Disks {
+		if d.Crypt != "" && d.ID == vmdata.Rootdisk {
+			return fmt.Errorf("encrypted rootdisk is not supported")
+		}
+		if d.Swap && d.ID == vmdata.Rootdisk {
+			return fmt.Errorf("rootdisk can't be used as swap")
+		}
+	}
+	if err := readDiskKeys(vmdata.Disks); err != nil {
+		return err
+	}
+	if err := checkOverlayDisk(vmdata); err != nil {
+		return err
+	}
 
 	// runq_exec can be disabled globally in daemon.json via the "--noexec" flag
 	// or via the container env variable "RUNQ_NOEXEC" with a true value.
@@ -338,6 +436,20 @@ func completeVmdata(vmdata *vm.Data) error {
 	}
 	vmdata.Entrypoint.Systemd = util.ToBool(os.Getenv("RUNQ_SYSTEMD"))
 
+	// Systemd images use cgroup v2 by default.
+	vmdata.Entrypoint.Cgroup = "v1"
+	if vmdata.Entrypoint.Systemd {
+		vmdata.Entrypoint.Cgroup = "v2"
+	}
+	if val, ok = os.LookupEnv("RUNQ_CGROUP"); ok {
+		switch val {
+		case "v1", "v2":
+			vmdata.Entrypoint.Cgroup = val
+		default:
+			return fmt.Errorf("env RUNQ_CGROUP: invalid value %q, want (v1|v2)", val)
+		}
+	}
+
 	// https://www.kernel.org/doc/html/latest/_sources/filesystems/9p.rst.txt
 	// default 9p chache mode 'mmap' is set in runc
 	if val, ok = os.LookupEnv("RUNQ_9PCACHE"); ok {
@@ -349,6 +461,25 @@ func completeVmdata(vmdata *vm.Data) error {
 		}
 	}
 
+	if val, ok = os.LookupEnv("RUNQ_SHARE"); ok {
+		switch val {
+		case "", "9p":
+		case "virtiofs":
+			if runtime.GOARCH != "amd64" {
+				return fmt.Errorf("env RUNQ_SHARE: virtiofs is not supported on %s", runtime.GOARCH)
+			}
+			vmdata.Share = val
+		default:
+			return fmt.Errorf("env RUNQ_SHARE: invalid value %q, want (9p|virtiofs)", val)
+		}
+	}
+	if val, ok = os.LookupEnv("RUNQ_VIRTIOFS_DAX"); ok {
+		vmdata.VirtiofsDAX = util.ToBool(val)
+		if vmdata.VirtiofsDAX && vmdata.Share != "virtiofs" {
+			return fmt.Errorf("env RUNQ_VIRTIOFS_DAX requires RUNQ_SHARE=virtiofs")
+		}
+	}
+
 	// default cpuargs 'host' is set in runc
 	if val, ok = os.LookupEnv("RUNQ_CPUARGS"); ok {
 		if val == "" {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -24,10 +25,20 @@ func qemuArgs(vmdata *vm.Data, socket, share string) ([]string, error) {
 		shareArgs = ",multidevs=remap"
 	}
 
+	memArgs := strconv.Itoa(vmdata.Mem)
+	var pmemSize int64
+	if vmdata.RootfsPmem != "" {
+		fi, err := os.Stat(vm.PmemImage)
+		if err != nil {
+			return nil, err
+		}
+		pmemSize = fi.Size() >> 20
+		memArgs += fmt.Sprintf(",slots=1,maxmem=%dM", int64(vmdata.Mem)+pmemSize)
+	}
+
 	args := []string{
 		"/usr/bin/qemu-system-x86_64",
 		"-device", "virtio-rng-pci,max-bytes=1024,period=1000" + virtioArgs,
-		"-device", "virtio-9p-pci,fsdev=share,mount_tag=" + shareName + virtioArgs,
 		"-device", "virtio-serial-pci" + virtioArgs,
 		"-serial", "chardev:console",
 		"-no-acpi",
@@ -44,15 +55,61 @@ func qemuArgs(vmdata *vm.Data, socket, share string) ([]string, error) {
 		"-kernel", "/kernel",
 		"-initrd", "/initrd",
 		"-msg", "timestamp=on",
-		"-fsdev", "local,id=share,path=" + share + ",security_model=none" + shareArgs,
 		"-chardev", "socket,path=" + socket + ",id=channel1",
-		"-device", "virtserialport,chardev=channel1,name=com.ibm.runq.channel.1",
+		"-device", "virtserialport,chardev=channel1,name=" + vm.ChannelPort,
 		"-smp", strconv.Itoa(vmdata.CPU),
-		"-m", strconv.Itoa(vmdata.Mem),
+		"-m", memArgs,
 		"-append", cfg.KernelParameters,
 		"-chardev", "stdio,id=console,signal=off",
 	}
 
+	// Seccomp user notifications are forwarded to the agent on the host.
+	if vmdata.SeccompAgent != nil {
+		args = append(args,
+			"-chardev", "socket,path="+vm.SeccompListener+",id=seccomp",
+			"-device", "virtserialport,chardev=seccomp,name="+vm.SeccompPort,
+		)
+	}
+
+	if vmdata.Share == "virtiofs" {
+		// vhost-user requires guest memory shared with virtiofsd.
+		var dax string
+		if vmdata.VirtiofsDAX {
+			dax = fmt.Sprintf(",cache-size=%dM", vmdata.Mem)
+		}
+		args = append(args,
+			"-chardev", "socket,id=virtiofs,path="+virtiofsSocket,
+			"-device", "vhost-user-fs-pci,queue-size=1024,chardev=virtiofs,tag="+shareName+dax+virtioArgs,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", vmdata.Mem),
+			"-numa", "node,memdev=mem",
+		)
+	} else {
+		args = append(args,
+			"-device", "virtio-9p-pci,fsdev=share,mount_tag="+shareName+virtioArgs,
+			"-fsdev", "local,id=share,path="+share+",security_model=none"+shareArgs,
+		)
+	}
+
+	for _, s := range vmdata.Shares9p {
+		var ro string
+		if s.Readonly {
+			ro = ",readonly=on"
+		}
+		args = append(args,
+			"-device", "virtio-9p-pci,fsdev="+s.Tag+",mount_tag="+s.Tag+virtioArgs,
+			"-fsdev", "local,id="+s.Tag+",path="+s.Path+",security_model=none"+shareArgs+ro,
+		)
+	}
+
+	if vmdata.RootfsPmem != "" {
+		// The image is opened and mapped read-only. Pages are shared with
+		// other VMs via the host page cache.
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-file,id=pmem,share=off,readonly=on,mem-path=%s,size=%dM", vm.PmemImage, pmemSize),
+			"-device", "virtio-pmem-pci,memdev=pmem,id=pmem0",
+		)
+	}
+
 	if vmdata.Vsockd.CID != 0 {
 		device := fmt.Sprintf("vhost-vsock-pci,guest-cid=%#x%s", vmdata.Vsockd.CID, virtioArgs)
 		args = append(args, "-device", device)
@@ -20,7 +20,6 @@ func qemuArgs(vmdata *vm.Data, socket, share string) ([]string, error) {
 
 	args := []string{
 		"/usr/bin/qemu-system-s390x",
-		"-device", "virtio-9p-ccw,fsdev=share,mount_tag=" + shareName,
 		"-device", "virtio-serial-ccw",
 		"-device", "sclpconsole,chardev=console",
 		"-machine", "accel=kvm,usb=off",
@@ -36,15 +35,38 @@ func qemuArgs(vmdata *vm.Data, socket, share string) ([]string, error) {
 		"-kernel", "/kernel",
 		"-initrd", "/initrd",
 		"-msg", "timestamp=on",
-		"-fsdev", "local,id=share,path=" + share + ",security_model=none" + shareArgs,
 		"-chardev", "socket,path=" + socket + ",id=channel1",
-		"-device", "virtserialport,chardev=channel1,name=com.ibm.runq.channel.1",
+		"-device", "virtserialport,chardev=channel1,name=" + vm.ChannelPort,
 		"-smp", strconv.Itoa(vmdata.CPU),
 		"-m", strconv.Itoa(vmdata.Mem),
 		"-append", cfg.KernelParameters,
 		"-chardev", "stdio,id=console,signal=off",
 	}
 
+	// Seccomp user notifications are forwarded to the agent on the host.
+	if vmdata.SeccompAgent != nil {
+		args = append(args,
+			"-chardev", "socket,path="+vm.SeccompListener+",id=seccomp",
+			"-device", "virtserialport,chardev=seccomp,name="+vm.SeccompPort,
+		)
+	}
+
+	args = append(args,
+		"-device", "virtio-9p-ccw,fsdev=share,mount_tag="+shareName,
+		"-fsdev", "local,id=share,path="+share+",security_model=none"+shareArgs,
+	)
+
+	for _, s := range vmdata.Shares9p {
+		var ro string
+		if s.Readonly {
+			ro = ",readonly=on"
+		}
+		args = append(args,
+			"-device", "virtio-9p-ccw,fsdev="+s.Tag+",mount_tag="+s.Tag,
+			"-fsdev", "local,id="+s.Tag+",path="+s.Path+",security_model=none"+shareArgs+ro,
+		)
+	}
+
 	if vmdata.Vsockd.CID != 0 {
 		device := fmt.Sprintf("vhost-vsock-ccw,guest-cid=%#x", vmdata.Vsockd.CID)
 		args = append(args, "-device", device)
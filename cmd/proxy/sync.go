@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gotoz/runq/internal/fscopy"
+	"golang.org/x/sys/unix"
+)
+
+// The manifest records the state of all files that have been copied from the
+// Docker image into the rootdisk.
+const (
+	manifestDir  = "/.runq"
+	manifestFile = manifestDir + "/manifest"
+	syncLogFile  = manifestDir + "/sync.log"
+)
+
+// dockerFiles are bind-mounted by Docker and copied on every start.
+var dockerFiles = []string{"/etc/hosts", "/etc/hostname", "/etc/resolv.conf"}
+
+// manifestEntry describes a single file.
+type manifestEntry struct {
+	Mode  uint32
+	UID   uint32
+	GID   uint32
+	Size  int64  `json:",omitempty"`
+	Mtime int64  `json:",omitempty"`
+	Link  string `json:",omitempty"`
+}
+
+func (e manifestEntry) isDir() bool {
+	return e.Mode&unix.S_IFMT == unix.S_IFDIR
+}
+
+// equal compares two entries. Size and modification time of directories
+// are ignored because they change with their content.
+func (e manifestEntry) equal(o manifestEntry) bool {
+	if e.Mode != o.Mode || e.UID != o.UID || e.GID != o.GID {
+		return false
+	}
+	if e.isDir() {
+		return true
+	}
+	return e.Size == o.Size && e.Mtime == o.Mtime && e.Link == o.Link
+}
+
+type manifest map[string]manifestEntry
+
+func newManifestEntry(path string, st *unix.Stat_t) (manifestEntry, error) {
+	e := manifestEntry{
+		Mode: st.Mode,
+		UID:  st.Uid,
+		GID:  st.Gid,
+	}
+	if e.isDir() {
+		return e, nil
+	}
+	e.Size = st.Size
+	e.Mtime = st.Mtim.Nano()
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return e, err
+		}
+		e.Link = link
+	}
+	return e, nil
+}
+
+// scanManifest creates a manifest of all files in root except excluded files
+// and the files managed by Docker.
+func scanManifest(root string, exclude []string) (manifest, error) {
+	m := make(manifest)
+	exclude = append(append([]string{}, exclude...), dockerFiles...)
+	err := fscopy.Walk(root, exclude, func(rel string, st *unix.Stat_t) error {
+		e, err := newManifestEntry(filepath.Join(root, rel), st)
+		if err != nil {
+			return err
+		}
+		m[rel] = e
+		return nil
+	})
+	return m, err
+}
+
+func readManifest(path string) (manifest, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(manifest)
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+func writeManifest(path string, m manifest) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// syncLog writes conflicts to the proxy log and to the sync log on the rootdisk.
+type syncLog struct {
+	f *os.File
+}
+
+func openSyncLog(path string) (*syncLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &syncLog{f}, nil
+}
+
+func (l *syncLog) printf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	log.Print("rootdisk sync: " + msg)
+	fmt.Fprintf(l.f, "%s %s\n", time.Now().UTC().Format(time.RFC3339), msg)
+}
+
+func (l *syncLog) close() error {
+	return l.f.Close()
+}
+
+// writeInitialManifest records the content of a newly filled rootdisk.
+func writeInitialManifest(src, dest string, exclude []string) error {
+	m, err := scanManifest(src, exclude)
+	if err != nil {
+		return err
+	}
+	return writeManifest(dest+manifestFile, m)
+}
+
+// syncImage updates the files of a reused rootdisk to the current Docker image.
+// Files are compared with the manifest of the previous sync. Only files the
+// user has not changed are created, updated or deleted. Changed files are kept
+// and reported as conflict.
+func syncImage(src, dest string, exclude []string) error {
+	exclude = append(append([]string{}, exclude...), manifestDir)
+
+	image, err := scanManifest(src, exclude)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dest+manifestDir, 0700); err != nil {
+		return err
+	}
+	slog, err := openSyncLog(dest + syncLogFile)
+	if err != nil {
+		return err
+	}
+	defer slog.close()
+
+	old, err := readManifest(dest + manifestFile)
+	if errors.Is(err, os.ErrNotExist) {
+		// Without a manifest it is unknown which files came from the image.
+		// Record files that are identical to the image and sync next time.
+		slog.printf("no manifest found, recording current state")
+		old = make(manifest)
+		for rel, n := range image {
+			if d, ok := diskEntry(dest, rel); ok && d.equal(n) {
+				old[rel] = n
+			}
+		}
+		return writeManifest(dest+manifestFile, old)
+	}
+	if err != nil {
+		return err
+	}
+
+	paths := make(map[string]bool)
+	for rel := range image {
+		paths[rel] = true
+	}
+	for rel := range old {
+		paths[rel] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for rel := range paths {
+		sorted = append(sorted, rel)
+	}
+	sort.Strings(sorted)
+
+	var copies, deletes []string
+	var conflicts, deleted int
+	for _, rel := range sorted {
+		o, inOld := old[rel]
+		n, inImage := image[rel]
+		d, onDisk := diskEntry(dest, rel)
+
+		switch {
+		case inOld && inImage && o.equal(n):
+			// unchanged in image
+		case !inOld && inImage:
+			// new in image
+			if !onDisk {
+				copies = append(copies, rel)
+			} else if !d.equal(n) {
+				slog.printf("conflict: %s exists on disk, keeping it", rel)
+				conflicts++
+			}
+		case inOld && !inImage:
+			// removed from image
+			if onDisk && d.equal(o) {
+				deletes = append(deletes, rel)
+			} else if onDisk {
+				slog.printf("conflict: %s was removed from image but changed on disk, keeping it", rel)
+				conflicts++
+			}
+		default:
+			// changed in image
+			switch {
+			case onDisk && d.equal(n):
+			case onDisk && d.equal(o):
+				copies = append(copies, rel)
+			case !onDisk:
+				slog.printf("conflict: %s was updated in image but deleted on disk, not restoring it", rel)
+				conflicts++
+			default:
+				slog.printf("conflict: %s was updated in image but changed on disk, keeping it", rel)
+				conflicts++
+			}
+		}
+	}
+
+	// Delete files first and directories deepest first. Directories
+	// that still contain user files are kept.
+	for i := len(deletes) - 1; i >= 0; i-- {
+		rel := deletes[i]
+		if err := os.Remove(dest + rel); err != nil {
+			if errors.Is(err, unix.ENOTEMPTY) || errors.Is(err, unix.EEXIST) {
+				slog.printf("conflict: %s was removed from image but is not empty, keeping it", rel)
+				conflicts++
+				continue
+			}
+			return fmt.Errorf("remove %s failed: %w", rel, err)
+		}
+		deleted++
+	}
+
+	// Directories that only changed their attributes are updated in place,
+	// everything else is copied. Children of copied directories are copied
+	// along with their parent.
+	var copyPaths []string
+	var copyDir string
+	for _, rel := range copies {
+		if copyDir != "" && strings.HasPrefix(rel, copyDir+"/") {
+			continue
+		}
+		n := image[rel]
+		if d, ok := diskEntry(dest, rel); ok && d.isDir() {
+			if n.isDir() {
+				if err := setAttributes(dest+rel, n); err != nil {
+					return fmt.Errorf("update %s failed: %w", rel, err)
+				}
+				continue
+			}
+			if err := os.Remove(dest + rel); err != nil {
+				slog.printf("conflict: %s is not a directory in image but not empty on disk, keeping it", rel)
+				conflicts++
+				continue
+			}
+		}
+		if n.isDir() {
+			copyDir = rel
+		}
+		copyPaths = append(copyPaths, rel)
+	}
+
+	if len(copyPaths) > 0 {
+		if _, err := fscopy.Copy(src, dest, fscopy.Options{Exclude: exclude, Paths: copyPaths}); err != nil {
+			return err
+		}
+	}
+	log.Printf("rootdisk sync: %d copied, %d deleted, %d conflicts", len(copyPaths), deleted, conflicts)
+
+	return writeManifest(dest+manifestFile, image)
+}
+
+func diskEntry(root, rel string) (manifestEntry, bool) {
+	var st unix.Stat_t
+	if err := unix.Lstat(root+rel, &st); err != nil {
+		return manifestEntry{}, false
+	}
+	e, err := newManifestEntry(root+rel, &st)
+	if err != nil {
+		return manifestEntry{}, false
+	}
+	return e, true
+}
+
+func setAttributes(path string, e manifestEntry) error {
+	if err := os.Lchown(path, int(e.UID), int(e.GID)); err != nil {
+		return err
+	}
+	return unix.Chmod(path, e.Mode&07777)
+}
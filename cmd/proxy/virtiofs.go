@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/gotoz/runq/internal/util"
+)
+
+const (
+	virtiofsd      = "/usr/lib/qemu/virtiofsd"
+	virtiofsSocket = "/dev/runq-virtiofs.sock"
+)
+
+// startVirtiofsd starts virtiofsd to share dir with the VM. Qemu connects to
+// virtiofsd via a vhost-user socket. virtiofsd terminates when Qemu disconnects.
+func startVirtiofsd(dir string) error {
+	if !util.FileExists(virtiofsd) {
+		return fmt.Errorf("%s not found", virtiofsd)
+	}
+	cmd := exec.Command(virtiofsd,
+		"-f",
+		"--socket-path="+virtiofsSocket,
+		"-o", "source="+dir,
+		"-o", "cache=auto",
+		"-o", "xattr",
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+	}
+	cmd.Dir = "/"
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start virtiofsd failed: %w", err)
+	}
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- cmd.Wait()
+	}()
+
+	// Wait for the socket.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-doneChan:
+			return fmt.Errorf("virtiofsd exited: %v", err)
+		case <-timeout:
+			cmd.Process.Kill()
+			return fmt.Errorf("virtiofsd did not create %s", virtiofsSocket)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if fi, err := os.Stat(virtiofsSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gotoz/runq/internal/vs"
 	"github.com/mdlayher/vsock"
@@ -25,13 +26,17 @@ var (
 	tlsCertDefault = filepath.Join(filepath.Dir(os.Args[0]), "cert.pem")
 	tlsKeyDefault  = filepath.Join(filepath.Dir(os.Args[0]), "key.pem")
 
-	env     = flag.StringArrayP("env", "e", nil, "Set environment variables for command")
-	help    = flag.BoolP("help", "h", false, "Print this help")
-	stdin   = flag.BoolP("interactive", "i", false, "Keep STDIN open even if not attached")
-	tlsCert = flag.StringP("tlscert", "c", tlsCertDefault, "TLS certificate file")
-	tlsKey  = flag.StringP("tlskey", "k", tlsKeyDefault, "TLS private key file")
-	tty     = flag.BoolP("tty", "t", false, "Allocate a pseudo-TTY")
-	version = flag.BoolP("version", "v", false, "Print version")
+	env           = flag.StringArrayP("env", "e", nil, "Set environment variables for command")
+	help          = flag.BoolP("help", "h", false, "Print this help")
+	stdin         = flag.BoolP("interactive", "i", false, "Keep STDIN open even if not attached")
+	tlsCert       = flag.StringP("tlscert", "c", tlsCertDefault, "TLS certificate file")
+	tlsKey        = flag.StringP("tlskey", "k", tlsKeyDefault, "TLS private key file")
+	tty           = flag.BoolP("tty", "t", false, "Allocate a pseudo-TTY")
+	freeze        = flag.Bool("freeze", false, "Freeze the filesystems of all disks")
+	thaw          = flag.Bool("thaw", false, "Thaw the filesystems of all disks")
+	freezeTimeout = flag.Duration("freeze-timeout", time.Minute, "Thaw frozen filesystems automatically after timeout")
+	diskStats     = flag.Bool("disk-stats", false, "Print usage and I/O statistics of all disks as JSON")
+	version       = flag.BoolP("version", "v", false, "Print version")
 
 	gitCommit     string
 	terminalState *term.State
@@ -44,14 +49,19 @@ func init() {
 
 func usage() {
 	fmt.Fprintln(os.Stderr, "Usage:")
-	fmt.Fprint(os.Stderr, "  runq-exec [options] <container> command args\n\n")
-	fmt.Fprint(os.Stderr, "Run a command in a running runq container\n\n")
+	fmt.Fprint(os.Stderr, "  runq-exec [options] <container> command args\n")
+	fmt.Fprint(os.Stderr, "  runq-exec --freeze|--thaw [options] <container>\n")
+	fmt.Fprint(os.Stderr, "  runq-exec --disk-stats [options] <container>\n\n")
+	fmt.Fprint(os.Stderr, "Run a command in a running runq container,\n")
+	fmt.Fprint(os.Stderr, "freeze/thaw the filesystems of its disks or print disk statistics\n\n")
 	fmt.Fprintln(os.Stderr, "Options:")
 	flag.PrintDefaults()
 	fmt.Fprintln(os.Stderr, "\nEnvironment Variable:")
 	fmt.Fprintln(os.Stderr, "  DOCKER_HOST    specifies the Docker daemon socket.")
 	fmt.Fprintln(os.Stderr, "\nExample:")
-	fmt.Fprint(os.Stderr, "  runq-exec -ti a6c3b7c bash\n\n")
+	fmt.Fprint(os.Stderr, "  runq-exec -ti a6c3b7c bash\n")
+	fmt.Fprint(os.Stderr, "  runq-exec --freeze --freeze-timeout 30s a6c3b7c\n")
+	fmt.Fprint(os.Stderr, "  runq-exec --disk-stats a6c3b7c\n\n")
 }
 
 func main() {
@@ -67,6 +77,20 @@ func main() {
 		fmt.Printf("%s (%s)\n", gitCommit, runtime.Version())
 		os.Exit(0)
 	}
+	if *freeze || *thaw {
+		if (*freeze && *thaw) || flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		os.Exit(runFs())
+	}
+	if *diskStats {
+		if flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		os.Exit(runDiskStats())
+	}
 	if flag.NArg() < 2 {
 		flag.Usage()
 		os.Exit(1)
@@ -87,11 +111,52 @@ func run() int {
 		WithStdin: *stdin,
 	}
 
-	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	tlsConfig, cid, err := vsockConfig()
 	if err != nil {
 		log.Print(err)
 		return 1
 	}
+
+	conn, err := vsock.Dial(cid, vs.Port, nil)
+	if err != nil {
+		log.Printf("failed to dial: %v", err)
+		return 1
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	jrGob, err := jr.Encode()
+	if err != nil {
+		log.Printf("failed to encode JobRequest: %v", err)
+		return 1
+	}
+
+	buf := append([]byte{vs.TypeControlConn}, jrGob...)
+	if _, err := tlsConn.Write(buf); err != nil {
+		log.Printf("failed to send initial request: %v", err)
+		return 1
+	}
+
+	var jobid vs.JobID
+	_, err = tlsConn.Read(jobid[:])
+	if err != nil {
+		log.Printf("failed to read job id: %v", err)
+		return 1
+	}
+
+	done := make(chan int, 1)
+	go execute(done, tlsConfig, cid, jobid)
+	go wait(done, tlsConn)
+	return <-done
+}
+
+// vsockConfig returns the TLS configuration and the vsock context ID of the container.
+func vsockConfig() (*tls.Config, uint32, error) {
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, 0, err
+	}
 	tlsConfig := &tls.Config{
 		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: true,
@@ -99,12 +164,28 @@ func run() int {
 
 	containerID, err := realContainerID(flag.Arg(0))
 	if err != nil {
-		log.Print(err)
-		return 1
+		return nil, 0, err
 	}
 
 	// generate cid from first 8 characters of container ID
 	cid, err := vs.ContextID(containerID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tlsConfig, cid, nil
+}
+
+// runFs freezes or thaws the filesystems of the disks inside the VM.
+func runFs() int {
+	fr := vs.FsRequest{
+		Op:      vs.FsThaw,
+		Timeout: *freezeTimeout,
+	}
+	if *freeze {
+		fr.Op = vs.FsFreeze
+	}
+
+	tlsConfig, cid, err := vsockConfig()
 	if err != nil {
 		log.Print(err)
 		return 1
@@ -119,29 +200,68 @@ func run() int {
 
 	tlsConn := tls.Client(conn, tlsConfig)
 
-	jrGob, err := jr.Encode()
+	frGob, err := fr.Encode()
 	if err != nil {
-		log.Printf("failed to encode JobRequest: %v", err)
+		log.Printf("failed to encode FsRequest: %v", err)
 		return 1
 	}
 
-	buf := append([]byte{vs.TypeControlConn}, jrGob...)
-	if _, err := tlsConn.Write(buf); err != nil {
-		log.Printf("failed to send initial request: %v", err)
+	if _, err := tlsConn.Write(append([]byte{vs.TypeFsConn}, frGob...)); err != nil {
+		log.Printf("failed to send request: %v", err)
 		return 1
 	}
 
-	var jobid vs.JobID
-	_, err = tlsConn.Read(jobid[:])
+	buf := make([]byte, 4096)
+	n, err := tlsConn.Read(buf)
 	if err != nil {
-		log.Printf("failed to read job id: %v", err)
+		log.Printf("failed to read response: %v", err)
 		return 1
 	}
+	if n == 1 && buf[0] == vs.Done {
+		return 0
+	}
+	log.Printf("%s failed: %s", fr.Op, buf[:n])
+	return 1
+}
 
-	done := make(chan int, 1)
-	go execute(done, tlsConfig, cid, jobid)
-	go wait(done, tlsConn)
-	return <-done
+// runDiskStats prints the statistics of the disks inside the VM.
+func runDiskStats() int {
+	tlsConfig, cid, err := vsockConfig()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	conn, err := vsock.Dial(cid, vs.Port, nil)
+	if err != nil {
+		log.Printf("failed to dial: %v", err)
+		return 1
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if _, err := tlsConn.Write([]byte{vs.TypeStatsConn}); err != nil {
+		log.Printf("failed to send request: %v", err)
+		return 1
+	}
+
+	buf, err := io.ReadAll(tlsConn)
+	if err != nil {
+		log.Printf("failed to read response: %v", err)
+		return 1
+	}
+	var stats []vs.DiskStats
+	if err := json.Unmarshal(buf, &stats); err != nil {
+		log.Printf("invalid response: %v", err)
+		return 1
+	}
+	out, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
 }
 
 // wait waits for early execution errors of the requested job or the final exit code
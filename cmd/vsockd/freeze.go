@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gotoz/runq/internal/util"
+	"github.com/gotoz/runq/internal/vs"
+)
+
+// fsFreezer freezes and thaws the filesystems of all disks.
+type fsFreezer struct {
+	sync.Mutex
+	mounts []string
+	timer  *time.Timer
+}
+
+// fsConnection processes a single filesystem request. On success vs.Done is
+// returned, otherwise an error message.
+func fsConnection(c net.Conn, buf []byte) {
+	defer c.Close()
+
+	fr, err := vs.DecodeFsRequest(buf)
+	if err != nil {
+		log.Printf("can't decode FsRequest: %v", err)
+		return
+	}
+
+	switch fr.Op {
+	case vs.FsFreeze:
+		err = freezer.freeze(fr.Timeout)
+	case vs.FsThaw:
+		err = freezer.thaw()
+	default:
+		err = fmt.Errorf("invalid filesystem operation %q", fr.Op)
+	}
+
+	if err != nil {
+		c.Write([]byte(err.Error()))
+		return
+	}
+	c.Write([]byte{vs.Done})
+}
+
+// freeze freezes all filesystems. They are thawed automatically after timeout.
+func (f *fsFreezer) freeze(timeout time.Duration) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.timer != nil {
+		return fmt.Errorf("filesystems are already frozen")
+	}
+	if len(f.mounts) == 0 {
+		return fmt.Errorf("no filesystems to freeze")
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("invalid timeout %v", timeout)
+	}
+	for i, m := range f.mounts {
+		if err := util.FreezeFS(m); err != nil {
+			f.thawMounts(f.mounts[:i])
+			return fmt.Errorf("freeze %s failed: %v", m, err)
+		}
+	}
+	var t *time.Timer
+	t = time.AfterFunc(timeout, func() {
+		f.Lock()
+		defer f.Unlock()
+		// The filesystems have been thawed and maybe frozen again
+		// meanwhile, which is handled by another timer.
+		if f.timer != t {
+			return
+		}
+		log.Printf("filesystems not thawed within %v, thawing", timeout)
+		f.timer = nil
+		f.thawMounts(f.mounts)
+	})
+	f.timer = t
+	return nil
+}
+
+// thaw thaws all filesystems.
+func (f *fsFreezer) thaw() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	return f.thawMounts(f.mounts)
+}
+
+func (f *fsFreezer) thawMounts(mounts []string) error {
+	var err error
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if e := util.ThawFS(mounts[i]); e != nil {
+			log.Printf("thaw %s failed: %v", mounts[i], e)
+			err = fmt.Errorf("thaw %s failed: %v", mounts[i], e)
+		}
+	}
+	return err
+}
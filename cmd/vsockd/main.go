@@ -29,6 +29,8 @@ var (
 	entrypointEnv []string
 	entrypointPid string
 	jobs          jobDB
+	freezer       fsFreezer
+	disks         []vm.DiskInfo
 )
 
 func init() {
@@ -84,6 +86,12 @@ func run() error {
 	}
 
 	entrypointEnv = vsockd.EntrypointEnv
+	disks = vsockd.Disks
+	for _, d := range disks {
+		if d.Path != "" {
+			freezer.mounts = append(freezer.mounts, d.Path)
+		}
+	}
 
 	jobs = jobDB{
 		m: make(map[vs.JobID]jobExecution),
@@ -162,7 +170,8 @@ func handleConnection(conn net.Conn) {
 		return
 	}
 
-	if n < 2 {
+	// Stats requests consist of the connection type only.
+	if n < 1 || (n < 2 && buf[0] != vs.TypeStatsConn) {
 		log.Print("message too short")
 		c.Close()
 		return
@@ -174,6 +183,10 @@ func handleConnection(conn net.Conn) {
 		controlConnection(c, buf[1:n])
 	case vs.TypeExecuteConn:
 		executeConnection(c, buf[1:n])
+	case vs.TypeFsConn:
+		fsConnection(c, buf[1:n])
+	case vs.TypeStatsConn:
+		statsConnection(c)
 	default:
 		log.Printf("invalid connection type %#x\n", buf[0])
 		c.Close()
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gotoz/runq/internal/vs"
+	"github.com/gotoz/runq/pkg/vm"
+	"golang.org/x/sys/unix"
+)
+
+// statsConnection sends the statistics of all disks encoded as JSON.
+func statsConnection(c net.Conn) {
+	defer c.Close()
+
+	stats := make([]vs.DiskStats, 0, len(disks))
+	for _, d := range disks {
+		stats = append(stats, diskStats(d))
+	}
+	buf, err := json.Marshal(stats)
+	if err != nil {
+		log.Printf("can't encode disk stats: %v", err)
+		return
+	}
+	if _, err := c.Write(buf); err != nil {
+		log.Printf("failed to write disk stats: %v", err)
+	}
+}
+
+func diskStats(d vm.DiskInfo) vs.DiskStats {
+	ds := vs.DiskStats{
+		ID:         d.ID,
+		Device:     d.Device,
+		Fstype:     d.Fstype,
+		Mountpoint: d.Mountpoint,
+	}
+
+	var errs []string
+	io, err := ioStats(d.Device)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	ds.IO = io
+
+	if d.Path != "" {
+		fs, err := fsStats(d.Path)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		ds.Filesystem = fs
+	}
+	ds.Error = strings.Join(errs, "; ")
+	return ds
+}
+
+func fsStats(path string) (*vs.FsStats, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return nil, fmt.Errorf("statfs %s: %v", path, err)
+	}
+	bsize := uint64(st.Bsize)
+	fs := &vs.FsStats{
+		SizeBytes:  st.Blocks * bsize,
+		UsedBytes:  (st.Blocks - st.Bfree) * bsize,
+		AvailBytes: st.Bavail * bsize,
+		Inodes:     st.Files,
+		InodesFree: st.Ffree,
+	}
+	// Same as df: reserved blocks are not available to users.
+	if total := st.Blocks - st.Bfree + st.Bavail; total > 0 {
+		used := st.Blocks - st.Bfree
+		fs.UsedPercent = (used*100 + total - 1) / total
+	}
+	return fs, nil
+}
+
+// ioStats parses /sys/block/<dev>/stat. Older kernels provide less fields.
+func ioStats(dev string) (*vs.IOStats, error) {
+	path := "/sys/block/" + dev + "/stat"
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Fields(string(buf))
+	if len(f) < 11 {
+		return nil, fmt.Errorf("%s: invalid format", path)
+	}
+	v := make([]uint64, 17)
+	for i := 0; i < len(f) && i < len(v); i++ {
+		if v[i], err = strconv.ParseUint(f[i], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	const sectorSize = 512
+	return &vs.IOStats{
+		ReadIOs:      v[0],
+		ReadMerges:   v[1],
+		ReadBytes:    v[2] * sectorSize,
+		ReadTimeMs:   v[3],
+		WriteIOs:     v[4],
+		WriteMerges:  v[5],
+		WriteBytes:   v[6] * sectorSize,
+		WriteTimeMs:  v[7],
+		InFlight:     v[8],
+		IOTimeMs:     v[9],
+		QueueTimeMs:  v[10],
+		DiscardIOs:   v[11],
+		DiscardBytes: v[13] * sectorSize,
+		FlushIOs:     v[15],
+	}, nil
+}
@@ -11,6 +11,10 @@ import (
 // MinMem declares the minimum amount of RAM a VM in MiB.
 const MinMem = 64
 
+// MemReserve declares the amount of RAM in MiB of a VM that is kept free
+// of the entrypoint cgroup for init and vsockd.
+const MemReserve = 32
+
 // KernelParameters defines kernel boot parameters.
 const KernelParameters = "console=ttyS0 panic=1 module.sig_enforce=1 loglevel=3"
 
@@ -74,10 +78,12 @@ var RlimitsMap = map[string]int{
 	"RLIMIT_STACK":      unix.RLIMIT_STACK,
 }
 
-// ReadonlyPaths sets the provided paths as RO inside the VM.
+// ReadonlyPaths sets the provided paths as RO inside the VM if the spec
+// has no readonly paths.
 var ReadonlyPaths = []string{"/proc/bus", "/proc/sysrq-trigger"}
 
-// MaskedPaths masks over the provided paths inside the VM.
+// MaskedPaths masks over the provided paths inside the VM if the spec has
+// no masked paths.
 var MaskedPaths = []string{
 	"/proc/kcore", "/proc/latency_stats", "/proc/timer_list", "/proc/timer_stats",
 	"/proc/sched_debug", "/proc/scsi", "/sys/firmware",
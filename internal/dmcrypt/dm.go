@@ -0,0 +1,235 @@
+// Package dmcrypt sets up encrypted block devices with the Linux device mapper.
+// It supports LUKS1, LUKS2 and plain dm-crypt volumes.
+package dmcrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// device-mapper ioctl interface, see linux/dm-ioctl.h
+const (
+	dmControl   = "/dev/mapper/control"
+	dmNameLen   = 128
+	dmUUIDLen   = 129
+	dmIoctlSize = 312
+	dmSpecSize  = 40
+
+	dmDevCreate  = 3
+	dmDevRemove  = 4
+	dmDevSuspend = 6
+	dmTableLoad  = 9
+
+	dmReadonlyFlag = 1 << 0
+)
+
+type dmIoctl struct {
+	Version     [3]uint32
+	DataSize    uint32
+	DataStart   uint32
+	TargetCount uint32
+	OpenCount   int32
+	Flags       uint32
+	EventNr     uint32
+	Padding     uint32
+	Dev         uint64
+	Name        [dmNameLen]byte
+	UUID        [dmUUIDLen]byte
+	Data        [7]byte
+}
+
+type dmTargetSpec struct {
+	SectorStart uint64
+	Length      uint64
+	Status      int32
+	Next        uint32
+	TargetType  [16]byte
+}
+
+func dmIoctlNr(cmd uintptr) uintptr {
+	// _IOWR(0xfd, cmd, struct dm_ioctl)
+	return 3<<30 | dmIoctlSize<<16 | 0xfd<<8 | cmd
+}
+
+func dmCall(cmd uintptr, io *dmIoctl, payload []byte) error {
+	f, err := os.OpenFile(dmControl, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	io.Version = [3]uint32{4, 0, 0}
+	io.DataStart = dmIoctlSize
+	io.DataSize = uint32(dmIoctlSize + len(payload))
+
+	// The payload may hold key material. Grow the buffer in advance so that
+	// there is only a single copy to wipe.
+	var buf bytes.Buffer
+	buf.Grow(int(io.DataSize))
+	defer func() { wipe(buf.Bytes()) }()
+	if err := binary.Write(&buf, binary.LittleEndian, io); err != nil {
+		return err
+	}
+	buf.Write(payload)
+	b := buf.Bytes()
+
+	if _, _, e := unix.Syscall(unix.SYS_IOCTL, f.Fd(), dmIoctlNr(cmd), uintptr(unsafe.Pointer(&b[0]))); e != 0 {
+		return e
+	}
+	return binary.Read(bytes.NewReader(b[:dmIoctlSize]), binary.LittleEndian, io)
+}
+
+// target describes a single device-mapper table entry.
+type target struct {
+	start, length uint64 // sectors
+	typ           string
+	params        []byte
+}
+
+// create creates and activates a device-mapper device.
+// It returns the path of the new device.
+func create(name string, readonly bool, t target) (string, error) {
+	if len(name) >= dmNameLen {
+		return "", fmt.Errorf("device name %q too long", name)
+	}
+	var io dmIoctl
+	copy(io.Name[:], name)
+	if err := dmCall(dmDevCreate, &io, nil); err != nil {
+		return "", fmt.Errorf("create %q failed: %w", name, err)
+	}
+	dev := io.Dev
+
+	// null terminated and padded to 8 bytes
+	params := make([]byte, (len(t.params)+8)&^7)
+	copy(params, t.params)
+	spec := dmTargetSpec{
+		SectorStart: t.start,
+		Length:      t.length,
+		Next:        uint32(dmSpecSize + len(params)),
+	}
+	copy(spec.TargetType[:], t.typ)
+	var payload bytes.Buffer
+	payload.Grow(dmSpecSize + len(params))
+	binary.Write(&payload, binary.LittleEndian, spec)
+	payload.Write(params)
+
+	io = dmIoctl{TargetCount: 1}
+	copy(io.Name[:], name)
+	if readonly {
+		io.Flags |= dmReadonlyFlag
+	}
+	err := dmCall(dmTableLoad, &io, payload.Bytes())
+	// The table contains the key.
+	wipe(params)
+	wipe(payload.Bytes())
+	if err != nil {
+		remove(name)
+		return "", fmt.Errorf("load table %q failed: %w", name, err)
+	}
+
+	// resume
+	io = dmIoctl{}
+	copy(io.Name[:], name)
+	if err := dmCall(dmDevSuspend, &io, nil); err != nil {
+		remove(name)
+		return "", fmt.Errorf("resume %q failed: %w", name, err)
+	}
+	return fmt.Sprintf("/dev/dm-%d", unix.Minor(dev)), nil
+}
+
+func remove(name string) error {
+	var io dmIoctl
+	copy(io.Name[:], name)
+	return dmCall(dmDevRemove, &io, nil)
+}
+
+// deviceSectors returns the size of a block device in 512 byte sectors.
+func deviceSectors(dev string) (uint64, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var size uint64
+	if _, _, e := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); e != 0 {
+		return 0, fmt.Errorf("get size of %s failed: %w", dev, e)
+	}
+	return size / 512, nil
+}
+
+// cryptParams returns the parameters of a dm-crypt table entry. The result
+// contains the key in hex and must be wiped by the caller. It is allocated
+// once so that no copies of the key are left behind.
+func cryptParams(cipher string, key []byte, ivOffset uint64, dev string, offset uint64, sectorSize int) []byte {
+	p := make([]byte, 0, len(cipher)+hex.EncodedLen(len(key))+len(dev)+128)
+	p = append(p, cipher...)
+	p = append(p, ' ')
+	n := len(p)
+	p = p[:n+hex.EncodedLen(len(key))]
+	hex.Encode(p[n:], key)
+	p = fmt.Appendf(p, " %d %s %d", ivOffset, dev, offset)
+	if sectorSize > 512 {
+		p = fmt.Appendf(p, " 1 sector_size:%d", sectorSize)
+	}
+	return p
+}
+
+// OpenPlain creates the device-mapper device name for a plain dm-crypt volume.
+// The key is used as is. It returns the path of the new device.
+func OpenPlain(dev, name, cipher string, key []byte) (string, error) {
+	if cipher == "" {
+		cipher = "aes-xts-plain64"
+	}
+	size, err := deviceSectors(dev)
+	if err != nil {
+		return "", err
+	}
+	params := cryptParams(cipher, key, 0, dev, 0, 512)
+	defer wipe(params)
+	return create(name, false, target{
+		length: size,
+		typ:    "crypt",
+		params: params,
+	})
+}
+
+// OpenLUKS unlocks a LUKS1 or LUKS2 volume with the passphrase and creates
+// the device-mapper device name. It returns the path of the new device.
+func OpenLUKS(dev, name string, passphrase []byte) (string, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	v, err := unlock(f, passphrase)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", dev, err)
+	}
+	defer v.wipe()
+
+	size, err := deviceSectors(dev)
+	if err != nil {
+		return "", err
+	}
+	length := v.length
+	if length == 0 {
+		if size <= v.offset {
+			return "", fmt.Errorf("%s: invalid payload offset", dev)
+		}
+		length = size - v.offset
+	}
+	params := cryptParams(v.cipher, v.key, v.ivOffset, dev, v.offset, v.sectorSize)
+	defer wipe(params)
+	return create(name, false, target{
+		length: length,
+		typ:    "crypt",
+		params: params,
+	})
+}
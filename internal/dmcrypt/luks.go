@@ -0,0 +1,526 @@
+package dmcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+var luksMagic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+// ErrNoKeyslot is returned if the passphrase does not unlock any keyslot.
+var ErrNoKeyslot = errors.New("no keyslot matches the passphrase")
+
+// volume describes an unlocked LUKS volume.
+type volume struct {
+	cipher     string
+	key        []byte
+	offset     uint64 // payload offset in sectors
+	length     uint64 // payload length in sectors, 0 means up to the end of the device
+	ivOffset   uint64
+	sectorSize int
+}
+
+func (v *volume) wipe() {
+	for i := range v.key {
+		v.key[i] = 0
+	}
+}
+
+// unlock reads the LUKS header and recovers the volume key.
+func unlock(r io.ReaderAt, passphrase []byte) (*volume, error) {
+	hdr := make([]byte, 8)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("read LUKS header failed: %w", err)
+	}
+	if !bytes.Equal(hdr[:6], luksMagic) {
+		return nil, errors.New("no LUKS header found")
+	}
+	switch v := binary.BigEndian.Uint16(hdr[6:]); v {
+	case 1:
+		return unlockLUKS1(r, passphrase)
+	case 2:
+		return unlockLUKS2(r, passphrase)
+	default:
+		return nil, fmt.Errorf("unsupported LUKS version %d", v)
+	}
+}
+
+func hashFunc(name string) (func() hash.Hash, error) {
+	switch strings.ToLower(name) {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported hash %q", name)
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// LUKS1 on-disk header, see LUKS1 On-Disk Format Specification.
+const (
+	luks1KeySlots      = 8
+	luks1KeyEnabled    = 0x00AC71F3
+	luks1DigestSize    = 20
+	luks1SaltSize      = 32
+	luks1HeaderSize    = 592
+	luks1KeyslotOffset = 208
+	luks1KeyslotSize   = 48
+)
+
+func unlockLUKS1(r io.ReaderAt, passphrase []byte) (*volume, error) {
+	h := make([]byte, luks1HeaderSize)
+	if _, err := r.ReadAt(h, 0); err != nil {
+		return nil, fmt.Errorf("read LUKS header failed: %w", err)
+	}
+	cipherName := cstring(h[8:40])
+	cipherMode := cstring(h[40:72])
+	hashSpec := cstring(h[72:104])
+	payloadOffset := binary.BigEndian.Uint32(h[104:])
+	keyBytes := int(binary.BigEndian.Uint32(h[108:]))
+	mkDigest := h[112 : 112+luks1DigestSize]
+	mkDigestSalt := h[132 : 132+luks1SaltSize]
+	mkDigestIter := int(binary.BigEndian.Uint32(h[164:]))
+
+	hf, err := hashFunc(hashSpec)
+	if err != nil {
+		return nil, err
+	}
+	encryption := cipherName + "-" + cipherMode
+
+	for i := 0; i < luks1KeySlots; i++ {
+		ks := h[luks1KeyslotOffset+i*luks1KeyslotSize:]
+		if binary.BigEndian.Uint32(ks) != luks1KeyEnabled {
+			continue
+		}
+		iterations := int(binary.BigEndian.Uint32(ks[4:]))
+		salt := ks[8 : 8+luks1SaltSize]
+		offset := int64(binary.BigEndian.Uint32(ks[40:])) * 512
+		stripes := int(binary.BigEndian.Uint32(ks[44:]))
+
+		key := pbkdf2.Key(passphrase, salt, iterations, keyBytes, hf)
+		mk, err := decryptKeyslot(r, encryption, key, offset, keyBytes, stripes, hf)
+		wipe(key)
+		if err != nil {
+			log.Printf("LUKS keyslot %d: %v", i, err)
+			continue
+		}
+		digest := pbkdf2.Key(mk, mkDigestSalt, mkDigestIter, luks1DigestSize, hf)
+		if subtle.ConstantTimeCompare(digest, mkDigest) == 1 {
+			return &volume{
+				cipher:     encryption,
+				key:        mk,
+				offset:     uint64(payloadOffset),
+				sectorSize: 512,
+			}, nil
+		}
+		wipe(mk)
+	}
+	return nil, ErrNoKeyslot
+}
+
+// LUKS2 metadata, see LUKS2 On-Disk Format Specification.
+type luks2Metadata struct {
+	Keyslots map[string]luks2Keyslot `json:"keyslots"`
+	Segments map[string]luks2Segment `json:"segments"`
+	Digests  map[string]luks2Digest  `json:"digests"`
+}
+
+type luks2Keyslot struct {
+	Type    string `json:"type"`
+	KeySize int    `json:"key_size"`
+	AF      struct {
+		Type    string `json:"type"`
+		Stripes int    `json:"stripes"`
+		Hash    string `json:"hash"`
+	} `json:"af"`
+	Area struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Size       string `json:"size"`
+		Encryption string `json:"encryption"`
+		KeySize    int    `json:"key_size"`
+	} `json:"area"`
+	KDF struct {
+		Type       string `json:"type"`
+		Hash       string `json:"hash"`
+		Iterations int    `json:"iterations"`
+		Time       uint32 `json:"time"`
+		Memory     uint32 `json:"memory"`
+		CPUs       uint8  `json:"cpus"`
+		Salt       string `json:"salt"`
+	} `json:"kdf"`
+}
+
+type luks2Segment struct {
+	Type       string `json:"type"`
+	Offset     string `json:"offset"`
+	Size       string `json:"size"`
+	IVTweak    string `json:"iv_tweak"`
+	Encryption string `json:"encryption"`
+	SectorSize int    `json:"sector_size"`
+}
+
+type luks2Digest struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Segments   []string `json:"segments"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       string   `json:"salt"`
+	Digest     string   `json:"digest"`
+}
+
+const luks2BinaryHeaderSize = 4096
+
+// Limits of the Argon2 parameters read from the untrusted header. The memory
+// limit is the maximum of cryptsetup.
+const (
+	maxArgon2Memory = 4 << 20 // KiB
+	maxArgon2Time   = 100
+	maxArgon2CPUs   = 16
+)
+
+// argon2MemoryLimit returns the memory in KiB a keyslot may use: half of the
+// memory of the VM. Keyslots that need more would get the VM OOM-killed.
+var argon2MemoryLimit = func() (uint32, error) {
+	buf, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 3 && f[0] == "MemTotal:" && f[2] == "kB" {
+			kb, err := strconv.ParseUint(f[1], 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemTotal: %w", err)
+			}
+			return uint32(kb / 2), nil
+		}
+	}
+	return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
+
+// errArgon2Memory is returned for keyslots that exceed argon2MemoryLimit.
+var errArgon2Memory = errors.New("not enough memory for argon2")
+
+func unlockLUKS2(r io.ReaderAt, passphrase []byte) (*volume, error) {
+	h := make([]byte, luks2BinaryHeaderSize)
+	if _, err := r.ReadAt(h, 0); err != nil {
+		return nil, fmt.Errorf("read LUKS header failed: %w", err)
+	}
+	hdrSize := binary.BigEndian.Uint64(h[8:])
+	if hdrSize <= luks2BinaryHeaderSize || hdrSize > 4<<20 {
+		return nil, fmt.Errorf("invalid LUKS2 header size %d", hdrSize)
+	}
+	area := make([]byte, hdrSize-luks2BinaryHeaderSize)
+	if _, err := r.ReadAt(area, luks2BinaryHeaderSize); err != nil {
+		return nil, fmt.Errorf("read LUKS2 metadata failed: %w", err)
+	}
+	var md luks2Metadata
+	if err := json.Unmarshal(bytes.TrimRight(area, "\x00"), &md); err != nil {
+		return nil, fmt.Errorf("invalid LUKS2 metadata: %w", err)
+	}
+
+	seg, ok := md.Segments["0"]
+	if !ok || seg.Type != "crypt" {
+		return nil, errors.New("LUKS2 crypt segment not found")
+	}
+	segOffset, err := strconv.ParseUint(seg.Offset, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid segment offset: %w", err)
+	}
+	var segLength uint64
+	if seg.Size != "dynamic" {
+		if segLength, err = strconv.ParseUint(seg.Size, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid segment size: %w", err)
+		}
+	}
+	var ivTweak uint64
+	if seg.IVTweak != "" {
+		if ivTweak, err = strconv.ParseUint(seg.IVTweak, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid segment iv_tweak: %w", err)
+		}
+	}
+	sectorSize := seg.SectorSize
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+
+	// Keyslots are tried in order. A keyslot that can't be used, e.g. because
+	// of an unsupported KDF, doesn't prevent unlocking with another one.
+	ids := make([]string, 0, len(md.Keyslots))
+	for id := range md.Keyslots {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	var memErr error
+	for _, id := range ids {
+		ks := md.Keyslots[id]
+		if ks.Type != "luks2" {
+			continue
+		}
+		dg, ok := keyslotDigest(md.Digests, id)
+		if !ok {
+			continue
+		}
+		mk, err := unlockLUKS2Keyslot(r, ks, passphrase)
+		if err != nil {
+			if errors.Is(err, errArgon2Memory) && memErr == nil {
+				memErr = fmt.Errorf("keyslot %s: %w", id, err)
+			}
+			log.Printf("LUKS keyslot %s: %v", id, err)
+			continue
+		}
+		match, err := verifyDigest(dg, mk)
+		if err != nil {
+			wipe(mk)
+			log.Printf("LUKS keyslot %s: %v", id, err)
+			continue
+		}
+		if match {
+			return &volume{
+				cipher:     seg.Encryption,
+				key:        mk,
+				offset:     segOffset / 512,
+				length:     segLength / 512,
+				ivOffset:   ivTweak,
+				sectorSize: sectorSize,
+			}, nil
+		}
+		wipe(mk)
+	}
+	if memErr != nil {
+		return nil, fmt.Errorf("%w, %w (increase RUNQ_MEM)", ErrNoKeyslot, memErr)
+	}
+	return nil, ErrNoKeyslot
+}
+
+// keyslotDigest returns the digest of the keyslot that belongs to segment 0.
+func keyslotDigest(digests map[string]luks2Digest, id string) (luks2Digest, bool) {
+	for _, d := range digests {
+		var slot, seg bool
+		for _, k := range d.Keyslots {
+			slot = slot || k == id
+		}
+		for _, s := range d.Segments {
+			seg = seg || s == "0"
+		}
+		if slot && seg {
+			return d, true
+		}
+	}
+	return luks2Digest{}, false
+}
+
+func unlockLUKS2Keyslot(r io.ReaderAt, ks luks2Keyslot, passphrase []byte) ([]byte, error) {
+	if ks.AF.Type != "luks1" {
+		return nil, fmt.Errorf("unsupported anti-forensic splitter %q", ks.AF.Type)
+	}
+	if ks.Area.Type != "raw" {
+		return nil, fmt.Errorf("unsupported keyslot area %q", ks.Area.Type)
+	}
+	offset, err := strconv.ParseInt(ks.Area.Offset, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyslot offset: %w", err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(ks.KDF.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kdf salt: %w", err)
+	}
+	hf, err := hashFunc(ks.AF.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if ks.Area.KeySize <= 0 || ks.Area.KeySize > 512 {
+		return nil, fmt.Errorf("invalid keyslot key size %d", ks.Area.KeySize)
+	}
+	if strings.HasPrefix(ks.KDF.Type, "argon2") {
+		if ks.KDF.Memory < 8 || ks.KDF.Memory > maxArgon2Memory {
+			return nil, fmt.Errorf("invalid argon2 memory %d KiB", ks.KDF.Memory)
+		}
+		if ks.KDF.Time < 1 || ks.KDF.Time > maxArgon2Time {
+			return nil, fmt.Errorf("invalid argon2 time %d", ks.KDF.Time)
+		}
+		if ks.KDF.CPUs < 1 || ks.KDF.CPUs > maxArgon2CPUs {
+			return nil, fmt.Errorf("invalid argon2 cpus %d", ks.KDF.CPUs)
+		}
+		limit, err := argon2MemoryLimit()
+		if err != nil {
+			return nil, err
+		}
+		if ks.KDF.Memory > limit {
+			return nil, fmt.Errorf("%w: needs %d KiB, limit is %d KiB", errArgon2Memory, ks.KDF.Memory, limit)
+		}
+	}
+
+	var key []byte
+	switch ks.KDF.Type {
+	case "pbkdf2":
+		kh, err := hashFunc(ks.KDF.Hash)
+		if err != nil {
+			return nil, err
+		}
+		key = pbkdf2.Key(passphrase, salt, ks.KDF.Iterations, ks.Area.KeySize, kh)
+	case "argon2i":
+		key = argon2.Key(passphrase, salt, ks.KDF.Time, ks.KDF.Memory, ks.KDF.CPUs, uint32(ks.Area.KeySize))
+	case "argon2id":
+		key = argon2.IDKey(passphrase, salt, ks.KDF.Time, ks.KDF.Memory, ks.KDF.CPUs, uint32(ks.Area.KeySize))
+	default:
+		return nil, fmt.Errorf("unsupported kdf %q", ks.KDF.Type)
+	}
+	defer wipe(key)
+
+	return decryptKeyslot(r, ks.Area.Encryption, key, offset, ks.KeySize, ks.AF.Stripes, hf)
+}
+
+func verifyDigest(d luks2Digest, mk []byte) (bool, error) {
+	if d.Type != "pbkdf2" {
+		return false, fmt.Errorf("unsupported digest %q", d.Type)
+	}
+	hf, err := hashFunc(d.Hash)
+	if err != nil {
+		return false, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(d.Salt)
+	if err != nil {
+		return false, fmt.Errorf("invalid digest salt: %w", err)
+	}
+	want, err := base64.StdEncoding.DecodeString(d.Digest)
+	if err != nil {
+		return false, fmt.Errorf("invalid digest: %w", err)
+	}
+	got := pbkdf2.Key(mk, salt, d.Iterations, len(want), hf)
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// decryptKeyslot reads and decrypts the key material of a keyslot and merges
+// the anti-forensic stripes into the volume key.
+func decryptKeyslot(r io.ReaderAt, encryption string, key []byte, offset int64, keyBytes, stripes int, hf func() hash.Hash) ([]byte, error) {
+	if keyBytes <= 0 || stripes <= 0 || keyBytes*stripes > 16<<20 {
+		return nil, errors.New("invalid key material size")
+	}
+	size := (keyBytes*stripes + 511) &^ 511
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("read key material failed: %w", err)
+	}
+	defer wipe(buf)
+	if err := decryptSectors(encryption, key, buf); err != nil {
+		return nil, err
+	}
+	return afMerge(buf[:keyBytes*stripes], keyBytes, stripes, hf), nil
+}
+
+// decryptSectors decrypts buf in place in 512 byte sectors starting at
+// sector 0. Supported are the cryptsetup defaults aes-xts-plain64 and
+// aes-cbc-essiv:sha256.
+func decryptSectors(encryption string, key, buf []byte) error {
+	switch encryption {
+	case "aes-xts-plain64", "aes-xts-plain":
+		c, err := xts.NewCipher(aes.NewCipher, key)
+		if err != nil {
+			return err
+		}
+		for s := 0; s*512 < len(buf); s++ {
+			sector := buf[s*512 : (s+1)*512]
+			c.Decrypt(sector, sector, uint64(s))
+		}
+	case "aes-cbc-essiv:sha256":
+		c, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		salt := sha256.Sum256(key)
+		essiv, err := aes.NewCipher(salt[:])
+		if err != nil {
+			return err
+		}
+		iv := make([]byte, aes.BlockSize)
+		for s := 0; s*512 < len(buf); s++ {
+			for i := range iv {
+				iv[i] = 0
+			}
+			binary.LittleEndian.PutUint64(iv, uint64(s))
+			essiv.Encrypt(iv, iv)
+			sector := buf[s*512 : (s+1)*512]
+			cipher.NewCBCDecrypter(c, iv).CryptBlocks(sector, sector)
+		}
+	default:
+		return fmt.Errorf("unsupported keyslot encryption %q", encryption)
+	}
+	return nil
+}
+
+// afMerge reverses the LUKS anti-forensic split.
+func afMerge(src []byte, blockSize, stripes int, hf func() hash.Hash) []byte {
+	d := make([]byte, blockSize)
+	for i := 0; i < stripes-1; i++ {
+		xor(d, src[i*blockSize:])
+		diffuse(d, hf)
+	}
+	xor(d, src[(stripes-1)*blockSize:])
+	return d
+}
+
+func diffuse(b []byte, hf func() hash.Hash) {
+	h := hf()
+	ds := h.Size()
+	var iv [4]byte
+	for i := 0; i*ds < len(b); i++ {
+		end := (i + 1) * ds
+		if end > len(b) {
+			end = len(b)
+		}
+		h.Reset()
+		binary.BigEndian.PutUint32(iv[:], uint32(i))
+		h.Write(iv[:])
+		h.Write(b[i*ds : end])
+		copy(b[i*ds:end], h.Sum(nil))
+	}
+}
+
+func xor(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,380 @@
+package dmcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// The images below are built according to the LUKS1 and LUKS2 on-disk format
+// specifications. TestCryptsetup checks images created by cryptsetup.
+
+const (
+	testKeySize = 64 // aes-xts-plain64 with 512 bit
+	testStripes = 4000
+	testAreaLen = 512 * 512 // key material of a keyslot, rounded up
+)
+
+func randBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// afSplit is the inverse of afMerge.
+func afSplit(t *testing.T, mk []byte) []byte {
+	t.Helper()
+	out := make([]byte, len(mk)*testStripes)
+	d := make([]byte, len(mk))
+	for i := 0; i < testStripes-1; i++ {
+		s := out[i*len(mk) : (i+1)*len(mk)]
+		copy(s, randBytes(t, len(mk)))
+		xor(d, s)
+		diffuse(d, sha256.New)
+	}
+	last := out[(testStripes-1)*len(mk):]
+	copy(last, d)
+	xor(last, mk)
+	return out
+}
+
+// keyMaterial returns the encrypted key material of a keyslot.
+func keyMaterial(t *testing.T, key, mk []byte) []byte {
+	t.Helper()
+	buf := make([]byte, testAreaLen)
+	copy(buf, afSplit(t, mk))
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s := 0; s*512 < len(buf); s++ {
+		sector := buf[s*512 : (s+1)*512]
+		c.Encrypt(sector, sector, uint64(s))
+	}
+	return buf
+}
+
+// luks1Image returns a LUKS1 image with a keyslot per passphrase in the
+// given keyslots.
+func luks1Image(t *testing.T, mk []byte, slots map[int][]byte) []byte {
+	t.Helper()
+	const iterations = 1000
+	img := make([]byte, 4096*512)
+	h := img[:luks1HeaderSize]
+	copy(h, luksMagic)
+	binary.BigEndian.PutUint16(h[6:], 1)
+	copy(h[8:], "aes")
+	copy(h[40:], "xts-plain64")
+	copy(h[72:], "sha256")
+	binary.BigEndian.PutUint32(h[104:], 4096)
+	binary.BigEndian.PutUint32(h[108:], testKeySize)
+	salt := randBytes(t, luks1SaltSize)
+	copy(h[112:], pbkdf2.Key(mk, salt, iterations, luks1DigestSize, sha256.New))
+	copy(h[132:], salt)
+	binary.BigEndian.PutUint32(h[164:], iterations)
+
+	for i, pass := range slots {
+		ks := h[luks1KeyslotOffset+i*luks1KeyslotSize:]
+		offset := 8 + i*testAreaLen/512
+		salt := randBytes(t, luks1SaltSize)
+		binary.BigEndian.PutUint32(ks, luks1KeyEnabled)
+		binary.BigEndian.PutUint32(ks[4:], iterations)
+		copy(ks[8:], salt)
+		binary.BigEndian.PutUint32(ks[40:], uint32(offset))
+		binary.BigEndian.PutUint32(ks[44:], testStripes)
+		key := pbkdf2.Key(pass, salt, iterations, testKeySize, sha256.New)
+		copy(img[offset*512:], keyMaterial(t, key, mk))
+	}
+	return img
+}
+
+type testKeyslot struct {
+	passphrase []byte
+	kdf        map[string]interface{}
+	invalid    bool // kdf is not supported or out of limits
+}
+
+// luks2Image returns a LUKS2 image with the given keyslots. Keys are derived
+// as given by the kdf of the keyslot. Invalid keyslots get random key
+// material.
+func luks2Image(t *testing.T, mk []byte, slots map[string]testKeyslot) []byte {
+	t.Helper()
+	const (
+		hdrSize  = 16384
+		areaBase = 32768
+	)
+	img := make([]byte, areaBase+len(slots)*testAreaLen)
+
+	keyslots := map[string]interface{}{}
+	var ids []string
+	i := 0
+	for id, s := range slots {
+		ids = append(ids, id)
+		offset := areaBase + i*testAreaLen
+		i++
+		salt := randBytes(t, 32)
+		kdf := map[string]interface{}{"salt": base64.StdEncoding.EncodeToString(salt)}
+		for k, v := range s.kdf {
+			kdf[k] = v
+		}
+		var key []byte
+		switch {
+		case s.invalid:
+			key = randBytes(t, testKeySize)
+		case kdf["type"] == "pbkdf2":
+			key = pbkdf2.Key(s.passphrase, salt, kdf["iterations"].(int), testKeySize, sha256.New)
+		case kdf["type"] == "argon2id":
+			key = argon2.IDKey(s.passphrase, salt, kdf["time"].(uint32), kdf["memory"].(uint32), kdf["cpus"].(uint8), testKeySize)
+		}
+		copy(img[offset:], keyMaterial(t, key, mk))
+		keyslots[id] = map[string]interface{}{
+			"type":     "luks2",
+			"key_size": testKeySize,
+			"af":       map[string]interface{}{"type": "luks1", "stripes": testStripes, "hash": "sha256"},
+			"area": map[string]interface{}{
+				"type":       "raw",
+				"offset":     strconv.Itoa(offset),
+				"size":       strconv.Itoa(testAreaLen),
+				"encryption": "aes-xts-plain64",
+				"key_size":   testKeySize,
+			},
+			"kdf": kdf,
+		}
+	}
+
+	salt := randBytes(t, 32)
+	md := map[string]interface{}{
+		"keyslots": keyslots,
+		"segments": map[string]interface{}{
+			"0": map[string]interface{}{
+				"type":        "crypt",
+				"offset":      "16777216",
+				"size":        "dynamic",
+				"iv_tweak":    "0",
+				"encryption":  "aes-xts-plain64",
+				"sector_size": 4096,
+			},
+		},
+		"digests": map[string]interface{}{
+			"0": map[string]interface{}{
+				"type":       "pbkdf2",
+				"keyslots":   ids,
+				"segments":   []string{"0"},
+				"hash":       "sha256",
+				"iterations": 1000,
+				"salt":       base64.StdEncoding.EncodeToString(salt),
+				"digest":     base64.StdEncoding.EncodeToString(pbkdf2.Key(mk, salt, 1000, 32, sha256.New)),
+			},
+		},
+	}
+	js, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(img, luksMagic)
+	binary.BigEndian.PutUint16(img[6:], 2)
+	binary.BigEndian.PutUint64(img[8:], hdrSize)
+	copy(img[luks2BinaryHeaderSize:hdrSize], js)
+	return img
+}
+
+func pbkdf2Slot(pass string) testKeyslot {
+	return testKeyslot{passphrase: []byte(pass), kdf: map[string]interface{}{"type": "pbkdf2", "hash": "sha256", "iterations": 1000}}
+}
+
+func argon2Slot(pass string, time, memory uint32, cpus uint8) testKeyslot {
+	return testKeyslot{passphrase: []byte(pass), kdf: map[string]interface{}{"type": "argon2id", "time": time, "memory": memory, "cpus": cpus}}
+}
+
+func invalidSlot(s testKeyslot) testKeyslot {
+	s.invalid = true
+	return s
+}
+
+func TestUnlockLUKS1(t *testing.T) {
+	mk := randBytes(t, testKeySize)
+	img := luks1Image(t, mk, map[int][]byte{0: []byte("first"), 3: []byte("second")})
+
+	for _, pass := range []string{"first", "second"} {
+		v, err := unlock(bytes.NewReader(img), []byte(pass))
+		if err != nil {
+			t.Fatalf("%s: %v", pass, err)
+		}
+		if !bytes.Equal(v.key, mk) {
+			t.Errorf("%s: wrong volume key", pass)
+		}
+		if v.cipher != "aes-xts-plain64" || v.offset != 4096 || v.sectorSize != 512 {
+			t.Errorf("%s: got %+v", pass, v)
+		}
+	}
+
+	if _, err := unlock(bytes.NewReader(img), []byte("wrong")); !errors.Is(err, ErrNoKeyslot) {
+		t.Errorf("wrong passphrase: got %v, want %v", err, ErrNoKeyslot)
+	}
+}
+
+func TestUnlockLUKS2(t *testing.T) {
+	mk := randBytes(t, testKeySize)
+	img := luks2Image(t, mk, map[string]testKeyslot{
+		"0": argon2Slot("first", 1, 64, 1),
+		"1": pbkdf2Slot("second"),
+	})
+
+	for _, pass := range []string{"first", "second"} {
+		v, err := unlock(bytes.NewReader(img), []byte(pass))
+		if err != nil {
+			t.Fatalf("%s: %v", pass, err)
+		}
+		if !bytes.Equal(v.key, mk) {
+			t.Errorf("%s: wrong volume key", pass)
+		}
+		if v.cipher != "aes-xts-plain64" || v.offset != 32768 || v.length != 0 || v.sectorSize != 4096 {
+			t.Errorf("%s: got %+v", pass, v)
+		}
+	}
+
+	if _, err := unlock(bytes.NewReader(img), []byte("wrong")); !errors.Is(err, ErrNoKeyslot) {
+		t.Errorf("wrong passphrase: got %v, want %v", err, ErrNoKeyslot)
+	}
+}
+
+func TestUnlockLUKS2InvalidKeyslots(t *testing.T) {
+	mk := randBytes(t, testKeySize)
+	img := luks2Image(t, mk, map[string]testKeyslot{
+		"0":  invalidSlot(testKeyslot{kdf: map[string]interface{}{"type": "scrypt"}}),
+		"1":  invalidSlot(argon2Slot("pass", 1, maxArgon2Memory+1, 1)),
+		"2":  invalidSlot(argon2Slot("pass", maxArgon2Time+1, 64, 1)),
+		"3":  invalidSlot(argon2Slot("pass", 1, 64, 0)),
+		"10": pbkdf2Slot("pass"),
+	})
+
+	v, err := unlock(bytes.NewReader(img), []byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v.key, mk) {
+		t.Error("wrong volume key")
+	}
+}
+
+func TestUnlockLUKS2MemoryLimit(t *testing.T) {
+	limit := argon2MemoryLimit
+	argon2MemoryLimit = func() (uint32, error) { return 32, nil }
+	defer func() { argon2MemoryLimit = limit }()
+
+	mk := randBytes(t, testKeySize)
+	img := luks2Image(t, mk, map[string]testKeyslot{
+		"0": invalidSlot(argon2Slot("pass", 1, 64, 1)),
+	})
+	_, err := unlock(bytes.NewReader(img), []byte("pass"))
+	if !errors.Is(err, ErrNoKeyslot) || !errors.Is(err, errArgon2Memory) {
+		t.Errorf("got %v, want %v and %v", err, ErrNoKeyslot, errArgon2Memory)
+	}
+}
+
+func TestCryptParams(t *testing.T) {
+	key := []byte{0x01, 0x23, 0xab, 0xff}
+	tests := []struct {
+		sectorSize int
+		want       string
+	}{
+		{512, "aes-xts-plain64 0123abff 8 /dev/vdb 32768"},
+		{4096, "aes-xts-plain64 0123abff 8 /dev/vdb 32768 1 sector_size:4096"},
+	}
+	for _, tt := range tests {
+		got := cryptParams("aes-xts-plain64", key, 8, "/dev/vdb", 32768, tt.sectorSize)
+		if string(got) != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// TestCryptsetup unlocks images created by cryptsetup.
+func TestCryptsetup(t *testing.T) {
+	cryptsetup, err := exec.LookPath("cryptsetup")
+	if err != nil {
+		t.Skip("cryptsetup not found")
+	}
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"luks1", []string{"--type", "luks1", "--pbkdf-force-iterations", "1000"}},
+		{"luks2-pbkdf2", []string{"--type", "luks2", "--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000"}},
+		{"luks2-argon2i", []string{"--type", "luks2", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32", "--pbkdf-parallel", "1"}},
+		{"luks2-argon2id", []string{"--type", "luks2", "--pbkdf", "argon2id", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32", "--pbkdf-parallel", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			img := filepath.Join(dir, "img")
+			mkFile := filepath.Join(dir, "mk")
+			pass1 := filepath.Join(dir, "pass1")
+			pass2 := filepath.Join(dir, "pass2")
+			mk := randBytes(t, testKeySize)
+			for name, data := range map[string][]byte{mkFile: mk, pass1: []byte("first"), pass2: []byte("second")} {
+				if err := os.WriteFile(name, data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(img, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(img, 32<<20); err != nil {
+				t.Fatal(err)
+			}
+
+			run := func(args ...string) {
+				t.Helper()
+				if out, err := exec.Command(cryptsetup, args...).CombinedOutput(); err != nil {
+					t.Fatalf("cryptsetup %v: %v %s", args, err, out)
+				}
+			}
+			args := []string{"luksFormat", "--batch-mode", "--cipher", "aes-xts-plain64", "--key-size", "512",
+				"--master-key-file", mkFile, "--key-file", pass1}
+			run(append(append(args, tt.args...), img)...)
+			// second keyslot
+			args = []string{"luksAddKey", "--batch-mode", "--key-file", pass1, "--key-slot", "5"}
+			run(append(append(args, tt.args[2:]...), img, pass2)...)
+
+			f, err := os.Open(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			for _, pass := range []string{"first", "second"} {
+				v, err := unlock(f, []byte(pass))
+				if err != nil {
+					t.Fatalf("%s: %v", pass, err)
+				}
+				if !bytes.Equal(v.key, mk) {
+					t.Errorf("%s: wrong volume key", pass)
+				}
+				if v.cipher != "aes-xts-plain64" {
+					t.Errorf("%s: got cipher %q", pass, v.cipher)
+				}
+			}
+			if _, err := unlock(f, []byte("wrong")); !errors.Is(err, ErrNoKeyslot) {
+				t.Errorf("wrong passphrase: got %v, want %v", err, ErrNoKeyslot)
+			}
+		})
+	}
+}
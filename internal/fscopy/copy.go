@@ -0,0 +1,232 @@
+package fscopy
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// file copies a regular file. The content is written into a temporary file
+// that is renamed when complete. Returns the number of bytes copied.
+func (c *copier) file(e entry) (int64, bool, error) {
+	src := filepath.Join(c.src, e.rel)
+	dst := filepath.Join(c.dst, e.rel)
+
+	var st unix.Stat_t
+	if err := unix.Lstat(dst, &st); err == nil && !changed(&e.st, &st) {
+		c.skipped.Add(1)
+		return 0, false, nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, false, &Error{"open", src, err}
+	}
+	defer in.Close()
+
+	// The random suffix avoids clashes with files of the source tree.
+	out, err := os.CreateTemp(filepath.Dir(dst), ".fscopy-*")
+	if err != nil {
+		return 0, false, &Error{"create", dst, err}
+	}
+	tmp := out.Name()
+	defer os.Remove(tmp)
+
+	n, err := copyData(out, in, e.st.Size)
+	if err != nil {
+		out.Close()
+		return 0, false, &Error{"copy", src, err}
+	}
+	if err := out.Close(); err != nil {
+		return 0, false, &Error{"close", tmp, err}
+	}
+	if err := c.metadata(tmp, &e.st); err != nil {
+		return 0, false, err
+	}
+	if err := xattrs(src, tmp); err != nil {
+		return 0, false, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		if !errors.Is(err, unix.EISDIR) && !errors.Is(err, unix.ENOTEMPTY) && !errors.Is(err, unix.EEXIST) {
+			return 0, false, &Error{"rename", dst, err}
+		}
+		if err := os.RemoveAll(dst); err != nil {
+			return 0, false, &Error{"remove", dst, err}
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			return 0, false, &Error{"rename", dst, err}
+		}
+	}
+	return n, true, nil
+}
+
+// copyData copies size bytes from in to out and skips holes. Filesystems
+// without SEEK_DATA support are copied sequentially.
+func copyData(out, in *os.File, size int64) (int64, error) {
+	var off, total int64
+	fd := int(in.Fd())
+	for off < size {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // only a hole is left
+		}
+		if err != nil {
+			if _, err := in.Seek(off, io.SeekStart); err != nil {
+				return total, err
+			}
+			if _, err := out.Seek(off, io.SeekStart); err != nil {
+				return total, err
+			}
+			n, err := io.Copy(out, in)
+			return total + n, err
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return total, err
+		}
+		if _, err := in.Seek(data, io.SeekStart); err != nil {
+			return total, err
+		}
+		if _, err := out.Seek(data, io.SeekStart); err != nil {
+			return total, err
+		}
+		n, err := io.CopyN(out, in, hole-data)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		off = hole
+	}
+	return total, out.Truncate(size)
+}
+
+// special creates symbolic links, device nodes, fifos and sockets.
+func (c *copier) special(e entry) error {
+	src := filepath.Join(c.src, e.rel)
+	dst := filepath.Join(c.dst, e.rel)
+
+	var target string
+	if e.st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		t, err := os.Readlink(src)
+		if err != nil {
+			return &Error{"readlink", src, err}
+		}
+		target = t
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(dst, &st); err == nil {
+		if !changed(&e.st, &st) {
+			if t, _ := os.Readlink(dst); t == target {
+				c.skipped.Add(1)
+				return nil
+			}
+		}
+		if err := os.RemoveAll(dst); err != nil {
+			return &Error{"remove", dst, err}
+		}
+	}
+
+	if target != "" {
+		if err := os.Symlink(target, dst); err != nil {
+			return &Error{"symlink", dst, err}
+		}
+	} else {
+		if err := unix.Mknod(dst, e.st.Mode, int(e.st.Rdev)); err != nil {
+			return &Error{"mknod", dst, err}
+		}
+	}
+	if err := c.metadata(dst, &e.st); err != nil {
+		return err
+	}
+	if err := xattrs(src, dst); err != nil {
+		return err
+	}
+	c.files.Add(1)
+	return nil
+}
+
+// metadata applies ownership, permissions and timestamps. Ownership must be
+// set first because chown clears the set-user-ID and set-group-ID bits.
+func (c *copier) metadata(path string, st *unix.Stat_t) error {
+	if err := unix.Lchown(path, int(st.Uid), int(st.Gid)); err != nil {
+		return &Error{"chown", path, err}
+	}
+	isLink := st.Mode&unix.S_IFMT == unix.S_IFLNK
+	if !isLink {
+		if err := unix.Chmod(path, st.Mode&07777); err != nil {
+			return &Error{"chmod", path, err}
+		}
+	}
+	ts := []unix.Timespec{st.Atim, st.Mtim}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &Error{"utimes", path, err}
+	}
+	return nil
+}
+
+// xattrs copies all extended attributes. POSIX ACLs are stored as
+// system.posix_acl_* attributes and are copied as well.
+func xattrs(src, dst string) error {
+	names, err := listxattr(src)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return &Error{"listxattr", src, err}
+	}
+	for _, name := range names {
+		// overlayfs internal attributes
+		if strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+		val, err := getxattr(src, name)
+		if err != nil {
+			return &Error{"getxattr " + name, src, err}
+		}
+		if err := unix.Lsetxattr(dst, name, val, 0); err != nil {
+			return &Error{"setxattr " + name, dst, err}
+		}
+	}
+	return nil
+}
+
+func listxattr(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	start := 0
+	for i, b := range buf[:size] {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names, nil
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
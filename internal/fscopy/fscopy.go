@@ -0,0 +1,459 @@
+// Package fscopy copies a directory tree and preserves file types, ownership,
+// permissions, timestamps, hardlinks, extended attributes (including POSIX ACLs),
+// device nodes and sparse files.
+package fscopy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Options defines how a tree is copied.
+type Options struct {
+	// Exclude is a list of glob patterns. A pattern that starts with "/" is
+	// matched against the path relative to the source root, all other patterns
+	// are matched against the base name. A trailing "/" matches directories only.
+	Exclude []string
+	// Paths limits the copy to the given paths relative to the source root.
+	// Parent directories are created as needed. Empty means everything.
+	Paths []string
+	// Workers is the number of parallel file copies. Defaults to NumCPU.
+	Workers int
+	// DryRun reports the changes without touching the destination.
+	DryRun bool
+	// Progress is called after each copied file. It must be safe for
+	// concurrent use.
+	Progress func(Progress)
+}
+
+// Progress describes the state of a running copy.
+type Progress struct {
+	Files int64
+	Bytes int64
+	Path  string
+}
+
+// Op is the kind of a change.
+type Op string
+
+// Change operations
+const (
+	Create Op = "create"
+	Update Op = "update"
+)
+
+// Change describes a single change of the destination.
+type Change struct {
+	Op   Op
+	Path string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s", c.Op, c.Path)
+}
+
+// Result is the summary of a copy.
+type Result struct {
+	Files   int64
+	Dirs    int64
+	Links   int64
+	Bytes   int64
+	Skipped int64
+	Changes []Change // DryRun only
+}
+
+// Error records a failed operation and the file that caused it.
+type Error struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+type entry struct {
+	rel string // path relative to the source root, starting with "/"
+	st  unix.Stat_t
+}
+
+type copier struct {
+	src, dst string
+	opts     Options
+
+	jobs   chan entry
+	wg     sync.WaitGroup
+	failed atomic.Bool
+	errMu  sync.Mutex
+	err    error
+
+	mu      sync.Mutex
+	inodes  map[inode]string
+	links   [][2]string
+	dirs    []entry
+	seen    map[string]bool
+	changes []Change
+
+	files, dirCount, linkCount, bytes, skipped atomic.Int64
+}
+
+// Copy copies the tree src into the directory dst. The destination directory
+// must exist. Files that exist in dst with the same size and modification time
+// as in src are not copied again.
+func Copy(src, dst string, opts Options) (*Result, error) {
+	if opts.Workers < 1 {
+		opts.Workers = runtime.NumCPU()
+	}
+	c := &copier{
+		src:    filepath.Clean(src),
+		dst:    filepath.Clean(dst),
+		opts:   opts,
+		jobs:   make(chan entry, opts.Workers*4),
+		inodes: make(map[inode]string),
+		seen:   make(map[string]bool),
+	}
+	if !opts.DryRun {
+		for i := 0; i < opts.Workers; i++ {
+			c.wg.Add(1)
+			go c.worker()
+		}
+	}
+
+	paths := opts.Paths
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for _, p := range paths {
+		rel := filepath.Join("/", p)
+		if err := c.parents(rel); err != nil {
+			c.fail(err)
+			break
+		}
+		if err := c.walk(rel); err != nil {
+			c.fail(err)
+			break
+		}
+	}
+	close(c.jobs)
+	c.wg.Wait()
+
+	if c.err == nil && !opts.DryRun {
+		c.fail(c.finish())
+	}
+	res := &Result{
+		Files:   c.files.Load(),
+		Dirs:    c.dirCount.Load(),
+		Links:   c.linkCount.Load(),
+		Bytes:   c.bytes.Load(),
+		Skipped: c.skipped.Load(),
+		Changes: c.changes,
+	}
+	return res, c.err
+}
+
+// Walk calls fn for every file below root that is not excluded. rel is the
+// path relative to root, starting with "/". The root itself is not reported.
+func Walk(root string, exclude []string, fn func(rel string, st *unix.Stat_t) error) error {
+	c := &copier{src: filepath.Clean(root), opts: Options{Exclude: exclude}}
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		path := filepath.Join(c.src, rel)
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err != nil {
+			return &Error{"lstat", path, err}
+		}
+		isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+		if rel != "/" {
+			if c.excluded(rel, isDir) {
+				return nil
+			}
+			if err := fn(rel, &st); err != nil {
+				return err
+			}
+		}
+		if !isDir {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return &Error{"open", path, err}
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return &Error{"readdir", path, err}
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if err := walk(filepath.Join(rel, n)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk("/")
+}
+
+func (c *copier) fail(err error) {
+	if err == nil {
+		return
+	}
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.failed.Store(true)
+}
+
+func (c *copier) excluded(rel string, isDir bool) bool {
+	for _, p := range c.opts.Exclude {
+		dirOnly := strings.HasSuffix(p, "/") && p != "/"
+		p = strings.TrimSuffix(p, "/")
+		if dirOnly && !isDir {
+			continue
+		}
+		name := filepath.Base(rel)
+		if strings.HasPrefix(p, "/") {
+			name = rel
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parents creates the parent directories of rel in the destination.
+func (c *copier) parents(rel string) error {
+	if rel == "/" {
+		return nil
+	}
+	var dirs []string
+	for d := filepath.Dir(rel); d != "/"; d = filepath.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+	}
+	for _, d := range dirs {
+		var st unix.Stat_t
+		if err := unix.Lstat(c.src+d, &st); err != nil {
+			return &Error{"lstat", c.src + d, err}
+		}
+		if err := c.dir(entry{d, st}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *copier) walk(rel string) error {
+	if c.failed.Load() {
+		return nil
+	}
+	path := filepath.Join(c.src, rel)
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return &Error{"lstat", path, err}
+	}
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	if rel != "/" && c.excluded(rel, isDir) {
+		return nil
+	}
+	e := entry{rel, st}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		if err := c.dir(e); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return &Error{"open", path, err}
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return &Error{"readdir", path, err}
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if err := c.walk(filepath.Join(rel, n)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case unix.S_IFREG:
+		if st.Nlink > 1 {
+			ino := inode{uint64(st.Dev), uint64(st.Ino)}
+			c.mu.Lock()
+			first, ok := c.inodes[ino]
+			if !ok {
+				c.inodes[ino] = rel
+			} else {
+				c.links = append(c.links, [2]string{first, rel})
+			}
+			c.mu.Unlock()
+			if ok {
+				if c.opts.DryRun {
+					c.dryRun(e)
+				}
+				c.linkCount.Add(1)
+				return nil
+			}
+		}
+		if c.opts.DryRun {
+			c.dryRun(e)
+			return nil
+		}
+		c.jobs <- e
+		return nil
+	default:
+		if c.opts.DryRun {
+			c.dryRun(e)
+			return nil
+		}
+		return c.special(e)
+	}
+}
+
+// dir creates a directory. Its metadata is applied after all files are copied
+// because creating entries inside the directory changes its timestamps.
+func (c *copier) dir(e entry) error {
+	if c.seen[e.rel] {
+		return nil
+	}
+	c.seen[e.rel] = true
+	c.dirCount.Add(1)
+	if c.opts.DryRun {
+		c.dryRun(e)
+		return nil
+	}
+	path := filepath.Join(c.dst, e.rel)
+	var st unix.Stat_t
+	err := unix.Lstat(path, &st)
+	if err == nil && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		if err := os.RemoveAll(path); err != nil {
+			return &Error{"remove", path, err}
+		}
+		err = unix.ENOENT
+	}
+	if errors.Is(err, unix.ENOENT) {
+		if err := unix.Mkdir(path, 0700); err != nil {
+			return &Error{"mkdir", path, err}
+		}
+	} else if err != nil {
+		return &Error{"lstat", path, err}
+	}
+	c.dirs = append(c.dirs, e)
+	return nil
+}
+
+func (c *copier) worker() {
+	defer c.wg.Done()
+	for e := range c.jobs {
+		if c.failed.Load() {
+			continue
+		}
+		n, copied, err := c.file(e)
+		if err != nil {
+			c.fail(err)
+			continue
+		}
+		if !copied {
+			continue
+		}
+		files := c.files.Add(1)
+		bytes := c.bytes.Add(n)
+		if c.opts.Progress != nil {
+			c.opts.Progress(Progress{Files: files, Bytes: bytes, Path: e.rel})
+		}
+	}
+}
+
+// finish creates hardlinks and applies directory metadata, deepest first.
+func (c *copier) finish() error {
+	for _, l := range c.links {
+		oldname := filepath.Join(c.dst, l[0])
+		newname := filepath.Join(c.dst, l[1])
+		if sameFile(oldname, newname) {
+			continue
+		}
+		if err := os.RemoveAll(newname); err != nil {
+			return &Error{"remove", newname, err}
+		}
+		if err := os.Link(oldname, newname); err != nil {
+			return &Error{"link", newname, err}
+		}
+	}
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		e := c.dirs[i]
+		dst := filepath.Join(c.dst, e.rel)
+		if err := xattrs(filepath.Join(c.src, e.rel), dst); err != nil {
+			return err
+		}
+		if err := c.metadata(dst, &e.st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dryRun records the change that a real copy would make.
+func (c *copier) dryRun(e entry) {
+	var st unix.Stat_t
+	op := Create
+	if err := unix.Lstat(filepath.Join(c.dst, e.rel), &st); err == nil {
+		if !changed(&e.st, &st) {
+			c.skipped.Add(1)
+			return
+		}
+		op = Update
+	}
+	if e.st.Mode&unix.S_IFMT == unix.S_IFREG {
+		c.files.Add(1)
+		c.bytes.Add(e.st.Size)
+	}
+	c.mu.Lock()
+	c.changes = append(c.changes, Change{op, e.rel})
+	c.mu.Unlock()
+}
+
+// changed reports whether the destination differs from the source.
+func changed(src, dst *unix.Stat_t) bool {
+	if src.Mode != dst.Mode || src.Uid != dst.Uid || src.Gid != dst.Gid {
+		return true
+	}
+	switch src.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		return false
+	case unix.S_IFCHR, unix.S_IFBLK:
+		return src.Rdev != dst.Rdev
+	}
+	return src.Size != dst.Size || src.Mtim != dst.Mtim
+}
+
+func sameFile(a, b string) bool {
+	var sa, sb unix.Stat_t
+	if unix.Lstat(a, &sa) != nil || unix.Lstat(b, &sb) != nil {
+		return false
+	}
+	return sa.Dev == sb.Dev && sa.Ino == sb.Ino
+}
@@ -0,0 +1,214 @@
+package fscopy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func lstat(t *testing.T, path string) *unix.Stat_t {
+	t.Helper()
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return &st
+}
+
+func TestCopyHardlinks(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a/file"), "data")
+	if err := os.MkdirAll(filepath.Join(src, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "a/file"), filepath.Join(src, "b/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Copy(src, dst, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 1 || res.Links != 1 {
+		t.Errorf("got %d files %d links, want 1 file 1 link", res.Files, res.Links)
+	}
+	st1 := lstat(t, filepath.Join(dst, "a/file"))
+	st2 := lstat(t, filepath.Join(dst, "b/link"))
+	if st1.Ino != st2.Ino {
+		t.Errorf("hardlink not preserved: inode %d != %d", st1.Ino, st2.Ino)
+	}
+	if st1.Nlink != 2 {
+		t.Errorf("got nlink %d, want 2", st1.Nlink)
+	}
+}
+
+func TestCopySparse(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	const size = 8 << 20
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{0xaa}, 4096)
+	if _, err := f.WriteAt(data, 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if st := lstat(t, filepath.Join(src, "sparse")); st.Blocks*512 >= size {
+		t.Skip("filesystem does not support sparse files")
+	}
+
+	res, err := Copy(src, dst, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Bytes != int64(len(data)) {
+		t.Errorf("got %d bytes copied, want %d", res.Bytes, len(data))
+	}
+	st := lstat(t, filepath.Join(dst, "sparse"))
+	if st.Size != size {
+		t.Errorf("got size %d, want %d", st.Size, size)
+	}
+	if st.Blocks*512 >= size {
+		t.Errorf("holes not preserved: %d blocks allocated", st.Blocks)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	copy(want[4<<20:], data)
+	if !bytes.Equal(got, want) {
+		t.Error("content differs")
+	}
+}
+
+func TestCopyXattrs(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	path := filepath.Join(src, "file")
+	writeFile(t, path, "data")
+	if err := unix.Lsetxattr(path, "user.fscopy", []byte("value"), 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("filesystem does not support user xattrs")
+		}
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(src, "user.dir", []byte("dir"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Copy(src, dst, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, name, want string
+	}{
+		{filepath.Join(dst, "file"), "user.fscopy", "value"},
+		{dst, "user.dir", "dir"},
+	}
+	for _, tt := range tests {
+		got, err := getxattr(tt.path, tt.name)
+		if err != nil {
+			t.Fatalf("getxattr %s %s: %v", tt.path, tt.name, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.path, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCopySymlinks(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "file"), "data")
+	if err := os.Symlink("file", filepath.Join(src, "rel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/nonexistent", filepath.Join(src, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	// An existing destination link with another target is replaced.
+	if err := os.Symlink("other", filepath.Join(dst, "rel")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Copy(src, dst, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"rel": "file", "dangling": "/nonexistent"} {
+		got, err := os.Readlink(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: got target %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCopyTempName(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "file"), "data")
+	writeFile(t, filepath.Join(src, ".fscopy-file"), "other")
+
+	if _, err := Copy(src, dst, Options{Workers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"file": "data", ".fscopy-file": "other"} {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCopyDryRun(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "new"), "new")
+	writeFile(t, filepath.Join(src, "changed"), "changed")
+	writeFile(t, filepath.Join(src, "same"), "same")
+	writeFile(t, filepath.Join(dst, "changed"), "old")
+	if _, err := Copy(src, dst, Options{Paths: []string{"/same"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Copy(src, dst, Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range res.Changes {
+		got = append(got, c.String())
+	}
+	sort.Strings(got)
+	want := []string{"create /new", "update /changed"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got changes %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "new")); !os.IsNotExist(err) {
+		t.Errorf("dry run created a file: %v", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dst, "changed")); string(b) != "old" {
+		t.Errorf("dry run changed a file: %q", b)
+	}
+}
@@ -1,6 +1,7 @@
 package loopback
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -8,54 +9,140 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// maxRetries limits the number of attempts to attach a file when free
+// devices are taken concurrently by other processes.
+const maxRetries = 10
+
 // Loopback defines a loopback device
 type Loopback struct {
-	Name   string
-	device *os.File
+	Name      string
+	Autoclear bool // detach automatically when the last user closes the device
+	DirectIO  bool // bypass the page cache of the backing file
+	ReadOnly  bool
+	device    *os.File
 }
 
 // New finds the first unused loopback device
 func New() (*Loopback, error) {
-	f, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0600)
+	name, err := nextFree()
 	if err != nil {
 		return nil, err
 	}
+	return &Loopback{
+		Name: name,
+	}, nil
+}
+
+// nextFree returns the name of the first unused loopback device. The device
+// node is created if it doesn't exist.
+func nextFree() (string, error) {
+	f, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0600)
+	if err != nil {
+		return "", err
+	}
 	defer f.Close()
 
 	nr, _, e1 := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.LOOP_CTL_GET_FREE, 0)
 	if e1 != 0 {
-		return nil, fmt.Errorf("Get next free loop device file: %v", e1.Error())
+		return "", fmt.Errorf("Get next free loop device file: %v", e1.Error())
 	}
 	name := fmt.Sprintf("/dev/loop%d", nr)
 
 	if _, err := os.Stat(name); err != nil {
-		if err := util.Mknod(name, "b", 0600, 7, int(nr)); err != nil {
-			return nil, fmt.Errorf("create %q failed: %v", name, err)
+		if err := util.Mknod(name, "b", 0600, 7, int(nr)); err != nil && !errors.Is(err, unix.EEXIST) {
+			return "", fmt.Errorf("create %q failed: %v", name, err)
 		}
 	}
-
-	return &Loopback{
-		Name: name,
-	}, nil
+	return name, nil
 }
 
-// Attach attaches a given raw file to an loop back device
+// Attach attaches a given raw file to an loop back device. If the device has
+// been taken by another process in the meantime the next free device is used.
 func (l *Loopback) Attach(file *os.File) error {
+	for i := 0; ; i++ {
+		err := l.attach(file)
+		if !errors.Is(err, unix.EBUSY) || i == maxRetries {
+			if err != nil {
+				return fmt.Errorf("Attach file to %q failed: %w", l.Name, err)
+			}
+			return nil
+		}
+		if l.Name, err = nextFree(); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *Loopback) attach(file *os.File) error {
 	f, err := os.OpenFile(l.Name, os.O_RDWR, 0600)
 	if err != nil {
 		return err
 	}
+
+	var info unix.LoopInfo64
+	copy(info.File_name[:len(info.File_name)-1], file.Name())
+	if l.Autoclear {
+		info.Flags |= unix.LO_FLAGS_AUTOCLEAR
+	}
+	if l.DirectIO {
+		info.Flags |= unix.LO_FLAGS_DIRECT_IO
+	}
+	if l.ReadOnly {
+		info.Flags |= unix.LO_FLAGS_READ_ONLY
+	}
+
+	// LOOP_CONFIGURE (Linux 5.8+) attaches and configures the device atomically.
+	err = unix.IoctlLoopConfigure(int(f.Fd()), &unix.LoopConfig{
+		Fd:   uint32(file.Fd()),
+		Info: info,
+	})
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+		err = l.setFd(f, file, info)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
 	l.device = f
+	return nil
+}
+
+// setFd is the fallback for kernels without LOOP_CONFIGURE.
+func (l *Loopback) setFd(f, file *os.File, info unix.LoopInfo64) error {
+	// The read-only mode is taken from the backing file.
+	if l.ReadOnly {
+		ro, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", file.Fd()), os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer ro.Close()
+		file = ro
+	}
 	if _, _, e1 := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.LOOP_SET_FD, file.Fd()); e1 != 0 {
-		return fmt.Errorf("Attach file to %q failed: %v", l.Name, e1.Error())
+		return e1
+	}
+
+	info.Flags &^= unix.LO_FLAGS_DIRECT_IO | unix.LO_FLAGS_READ_ONLY
+	if err := unix.IoctlLoopSetStatus64(int(f.Fd()), &info); err != nil {
+		unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.LOOP_CLR_FD, 0)
+		return err
+	}
+
+	// Direct I/O is optional, not all filesystems support it.
+	if l.DirectIO {
+		unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.LOOP_SET_DIRECT_IO, 1)
 	}
 	return nil
 }
 
-// Detach detaches the device
+// Detach detaches the device. Devices with autoclear may already have been
+// detached by the kernel.
 func (l *Loopback) Detach() error {
 	defer l.device.Close()
 	if _, _, e1 := unix.Syscall(unix.SYS_IOCTL, l.device.Fd(), unix.LOOP_CLR_FD, 0); e1 != 0 {
+		if l.Autoclear && e1 == unix.ENXIO {
+			return nil
+		}
 		return fmt.Errorf("Detach file from %q failed: %v", l.Name, e1.Error())
 	}
 	return nil
@@ -0,0 +1,122 @@
+package loopback
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFile returns a backing file of 1 MiB. The test is skipped without
+// permission to attach loop devices.
+func newFile(t *testing.T) *os.File {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := os.Stat("/dev/loop-control"); err != nil {
+		t.Skip("no loop devices")
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := f.Truncate(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// sysfs returns the content of a sysfs attribute of a loop device.
+func sysfs(t *testing.T, dev, attr string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(dev), attr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestAttach(t *testing.T) {
+	tests := []struct {
+		name      string
+		autoclear bool
+		readonly  bool
+	}{
+		{"default", false, false},
+		{"autoclear", true, false},
+		{"readonly", false, true},
+		{"autoclear readonly", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := newFile(t)
+			l, err := New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Autoclear = tt.autoclear
+			l.ReadOnly = tt.readonly
+			if err := l.Attach(file); err != nil {
+				t.Fatal(err)
+			}
+			defer l.Detach()
+
+			if got := sysfs(t, l.Name, "loop/backing_file"); got != file.Name() {
+				t.Errorf("got backing file %q, want %q", got, file.Name())
+			}
+			want := map[bool]string{false: "0", true: "1"}
+			if got := sysfs(t, l.Name, "loop/autoclear"); got != want[tt.autoclear] {
+				t.Errorf("got autoclear %s, want %s", got, want[tt.autoclear])
+			}
+			if got := sysfs(t, l.Name, "ro"); got != want[tt.readonly] {
+				t.Errorf("got ro %s, want %s", got, want[tt.readonly])
+			}
+
+			// Read-only devices either can't be opened for writing or
+			// fail the write.
+			f, err := os.OpenFile(l.Name, os.O_WRONLY, 0)
+			if err == nil {
+				_, err = f.WriteAt([]byte("data"), 0)
+				if err == nil {
+					err = f.Sync()
+				}
+				f.Close()
+			}
+			if tt.readonly && err == nil {
+				t.Error("write to read-only device succeeded")
+			}
+			if !tt.readonly && err != nil {
+				t.Errorf("write failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestAutoclear(t *testing.T) {
+	file := newFile(t)
+	l, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Autoclear = true
+	if err := l.Attach(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel detaches the device when the last user closes it,
+	// e.g. if the proxy dies before Detach.
+	l.device.Close()
+	loop := filepath.Join("/sys/block", filepath.Base(l.Name), "loop")
+	for i := 0; ; i++ {
+		if _, err := os.Stat(loop); os.IsNotExist(err) {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("%s has not been detached", l.Name)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
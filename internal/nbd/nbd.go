@@ -0,0 +1,134 @@
+// Package nbd attaches disk images such as qcow2 to network block devices
+// of the host via qemu-nbd.
+package nbd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotoz/runq/internal/util"
+	"golang.org/x/sys/unix"
+)
+
+const qemuNbd = "/usr/bin/qemu-nbd"
+
+// NBD defines a network block device served by qemu-nbd.
+type NBD struct {
+	Name string
+	fd   int // exclusive claim of the device until it is connected
+	pid  int // qemu-nbd server in the PID namespace of the caller
+}
+
+// New finds the first unused network block device and claims it by an
+// exclusive open. Devices claimed by a concurrent New are skipped.
+// The nbd kernel module must be loaded on the host.
+func New() (*NBD, error) {
+	devs, err := filepath.Glob("/sys/block/nbd*")
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("no nbd devices found. Is kernel module 'nbd' loaded?")
+	}
+	for _, d := range devs {
+		// A connected device has a pid file.
+		if _, err := os.Stat(d + "/pid"); err == nil {
+			continue
+		}
+		name := "/dev/" + filepath.Base(d)
+		if _, err := os.Stat(name); err != nil {
+			major, minor, err := util.MajorMinor(d + "/dev")
+			if err != nil {
+				return nil, err
+			}
+			if err := util.Mknod(name, "b", 0600, major, minor); err != nil {
+				return nil, fmt.Errorf("create %q failed: %v", name, err)
+			}
+		}
+		// qemu-nbd opens the device without O_EXCL.
+		fd, err := unix.Open(name, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
+		if err == unix.EBUSY {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("open %q failed: %v", name, err)
+		}
+		// The device may have been connected since the pid check.
+		if _, err := os.Stat(d + "/pid"); err == nil {
+			unix.Close(fd)
+			continue
+		}
+		return &NBD{
+			Name: name,
+			fd:   fd,
+		}, nil
+	}
+	return nil, fmt.Errorf("no free nbd device found")
+}
+
+// Connect connects an image file with the given format (e.g. "qcow2") to the device.
+// The claim of the device is released, a connected device has a pid file.
+func (n *NBD) Connect(file, format string) error {
+	defer unix.Close(n.fd)
+
+	// qemu-nbd runs as daemon. Its pid file is written in our PID namespace,
+	// unlike the pid in sysfs which belongs to the namespace of the host.
+	dir, err := os.MkdirTemp("", "qemu-nbd-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+
+	cmd := exec.Command(qemuNbd, "--connect="+n.Name, "--format="+format, "--cache=writeback", "--pid-file="+pidFile, file)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Connect %q to %q failed: %v %s", file, n.Name, err, strings.TrimSpace(string(out)))
+	}
+	buf, err := os.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("Connect %q to %q failed: %v", file, n.Name, err)
+	}
+	n.pid, err = strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return fmt.Errorf("Connect %q to %q: invalid pid file: %v", file, n.Name, err)
+	}
+
+	// The device is ready when the kernel reports the pid of the server.
+	pid := filepath.Join("/sys/block", filepath.Base(n.Name), "pid")
+	for i := 0; i < 50; i++ {
+		if util.FileExists(pid) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("Connect %q to %q: timeout", file, n.Name)
+}
+
+// Disconnect disconnects the device and waits for the qemu-nbd server to exit
+// so that the image is no longer locked.
+func (n *NBD) Disconnect() error {
+	cmd := exec.Command(qemuNbd, "--disconnect", n.Name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Disconnect %q failed: %v %s", n.Name, err, strings.TrimSpace(string(out)))
+	}
+	if n.pid == 0 {
+		return nil
+	}
+	for i := 0; i < 50; i++ {
+		// The server is not reaped by the proxy, a zombie is fine.
+		buf, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", n.pid))
+		if err != nil {
+			return nil
+		}
+		if f := strings.Fields(string(buf)); len(f) > 2 && f[2] == "Z" {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("Disconnect %q: qemu-nbd pid %d did not exit", n.Name, n.pid)
+}
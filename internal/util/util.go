@@ -49,7 +49,7 @@ func Mknod(path, devtype string, fmode uint32, major, minor int) error {
 
 	dev := minor&0xfff00<<12 | major&0xfff<<8 | minor&0xff
 	if err := unix.Mknod(path, mode, dev); err != nil {
-		return fmt.Errorf("Mknod %s failed: %v", path, err)
+		return fmt.Errorf("Mknod %s failed: %w", path, err)
 	}
 	return nil
 }
@@ -137,6 +137,36 @@ func Killall() {
 	}
 }
 
+// see linux/fs.h
+const (
+	fiFreeze = 0xc0045877 // _IOWR('X', 119, int)
+	fiThaw   = 0xc0045878 // _IOWR('X', 120, int)
+)
+
+// FreezeFS freezes the filesystem mounted at path.
+func FreezeFS(path string) error {
+	return fsIoctl(path, fiFreeze)
+}
+
+// ThawFS thaws the filesystem mounted at path. Filesystems that are not
+// frozen are ignored.
+func ThawFS(path string) error {
+	err := fsIoctl(path, fiThaw)
+	if err == unix.EINVAL {
+		return nil
+	}
+	return err
+}
+
+func fsIoctl(path string, req uint) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.IoctlSetInt(fd, req, 0)
+}
+
 // ErrorToRc turns an error value into a Bash like exit code and an error message.
 func ErrorToRc(err error) (uint8, string) {
 	if err == nil {
@@ -205,6 +235,40 @@ func ToBool(s string) bool {
 	return false
 }
 
+// ParseSize parses a size such as "512M" or "4G" and returns the number of
+// bytes. Suffixes K, M, G and T are binary multiples, an optional "B" or, after
+// a multiple, "iB" is ignored. A value without suffix is taken as bytes.
+func ParseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	iec := strings.HasSuffix(v, "IB")
+	if iec {
+		v = strings.TrimSuffix(v, "IB")
+	} else {
+		v = strings.TrimSuffix(v, "B")
+	}
+	var shift uint
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift || (iec && shift == 0) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
 // MachineType returns the s390x machine type
 // z13 : 2965
 // z14 : 3906
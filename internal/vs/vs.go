@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"time"
 )
 
 // Port is the listening port number of vsockd process.
@@ -16,9 +17,17 @@ const Port = 1
 const (
 	TypeControlConn byte = iota // connection to submit a new job
 	TypeExecuteConn             // connection to start a job and handle IO
+	TypeFsConn                  // connection to freeze or thaw filesystems
+	TypeStatsConn               // connection to request disk statistics
 	Done                        // indicates that the job has finished
 )
 
+// Filesystem operations
+const (
+	FsFreeze = "freeze"
+	FsThaw   = "thaw"
+)
+
 // JobID is used to connect a control connection to an execute connection.
 type JobID [4]byte
 
@@ -50,6 +59,73 @@ func DecodeJobRequest(buf []byte) (*JobRequest, error) {
 	return ec, nil
 }
 
+// FsRequest defines a filesystem operation inside a runq vm. Frozen
+// filesystems are thawed automatically after Timeout.
+type FsRequest struct {
+	Op      string
+	Timeout time.Duration
+}
+
+// Encode encodes a filesystem request into gob binary format.
+func (fr FsRequest) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(fr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeFsRequest decodes a byte buffer into a filesystem request object.
+func DecodeFsRequest(buf []byte) (*FsRequest, error) {
+	dec := gob.NewDecoder(bytes.NewBuffer(buf))
+	fr := new(FsRequest)
+	if err := dec.Decode(fr); err != nil {
+		return nil, err
+	}
+	return fr, nil
+}
+
+// DiskStats contains usage and I/O statistics of a disk.
+type DiskStats struct {
+	ID         string   `json:"id"`
+	Device     string   `json:"device"`
+	Fstype     string   `json:"fstype,omitempty"`
+	Mountpoint string   `json:"mountpoint,omitempty"`
+	Filesystem *FsStats `json:"filesystem,omitempty"`
+	IO         *IOStats `json:"io,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// FsStats contains filesystem usage as reported by statfs.
+type FsStats struct {
+	SizeBytes   uint64 `json:"size_bytes"`
+	UsedBytes   uint64 `json:"used_bytes"`
+	AvailBytes  uint64 `json:"avail_bytes"`
+	Inodes      uint64 `json:"inodes"`
+	InodesFree  uint64 `json:"inodes_free"`
+	UsedPercent uint64 `json:"used_percent"`
+}
+
+// IOStats contains the I/O counters of a block device, see
+// Documentation/block/stat.rst of the Linux kernel.
+type IOStats struct {
+	ReadIOs      uint64 `json:"read_ios"`
+	ReadMerges   uint64 `json:"read_merges"`
+	ReadBytes    uint64 `json:"read_bytes"`
+	ReadTimeMs   uint64 `json:"read_time_ms"`
+	WriteIOs     uint64 `json:"write_ios"`
+	WriteMerges  uint64 `json:"write_merges"`
+	WriteBytes   uint64 `json:"write_bytes"`
+	WriteTimeMs  uint64 `json:"write_time_ms"`
+	InFlight     uint64 `json:"in_flight"`
+	IOTimeMs     uint64 `json:"io_time_ms"`
+	QueueTimeMs  uint64 `json:"queue_time_ms"`
+	DiscardIOs   uint64 `json:"discard_ios"`
+	DiscardBytes uint64 `json:"discard_bytes"`
+	FlushIOs     uint64 `json:"flush_ios"`
+}
+
 // ContextID returns a (uint32) number based on the given input string.
 // The input string must consists of at least 8 hexadecimal characters.
 func ContextID(id string) (uint32, error) {
@@ -17,6 +17,24 @@ import (
 // QemuMountPt is used to bind mount /var/lib/runq/qemu
 const QemuMountPt = "/.qemu.mnt"
 
+// DiskKeyDir is used to bind mount the keys of encrypted disks.
+const DiskKeyDir = "/dev/runq-keys"
+
+// Share9pDir is used to bind mount volumes with their own 9p share.
+const Share9pDir = "/dev/runq-9p"
+
+// PmemImage is used to bind mount the image of the read-only rootfs layers.
+const PmemImage = "/dev/runq-pmem.img"
+
+// SeccompListener is used to bind mount the socket of the seccomp agent.
+const SeccompListener = "/dev/runq-seccomp.sock"
+
+// Names of the virtio serial ports.
+const (
+	ChannelPort = "com.ibm.runq.channel.1"
+	SeccompPort = "com.ibm.runq.seccomp.1"
+)
+
 // Msgtype declares the type of a message.
 type Msgtype uint8
 
@@ -67,15 +85,37 @@ type Network struct {
 // Disk defines a disk.
 type Disk struct {
 	Cache  string
+	Cipher string // dm-crypt cipher for plain mode
+	Crypt  string // luks or plain
 	Dir    string
 	Fstype string
 	ID     string
+	Key    []byte // key or passphrase of an encrypted disk
 	Mount  bool
 	Path   string
 	Serial string
+	Swap   bool // use disk as swap space
 	Type   Disktype
 }
 
+// DiskInfo describes a disk as set up inside the VM.
+type DiskInfo struct {
+	Device     string // block device e.g. vda
+	Fstype     string
+	ID         string
+	Mountpoint string // mount point in the container
+	Path       string // mount point in the VM
+}
+
+// Share9p defines an extra 9p share for a single volume.
+type Share9p struct {
+	Cache    string
+	Path     string // path in the proxy container
+	Readonly bool
+	Tag      string
+	Target   string
+}
+
 // Mount defines a mount point.
 type Mount struct {
 	Data   string
@@ -93,6 +133,95 @@ type User struct {
 	AdditionalGids []uint32
 }
 
+// IDMap defines a user namespace id mapping.
+type IDMap struct {
+	ContainerID uint32
+	HostID      uint32 // id outside of the user namespace
+	Size        uint32
+}
+
+// Device defines a character device of the container.
+type Device struct {
+	FileMode uint32 // permission bits
+	GID      uint32
+	Major    int64
+	Minor    int64
+	Path     string
+	Type     string // c or u
+	UID      uint32
+}
+
+// Hook defines a hook that is executed inside the VM.
+type Hook struct {
+	Args    []string
+	Env     []string
+	Path    string // path in the container
+	Timeout int    // seconds, 0 for no timeout
+}
+
+// Hooks contains the hooks that are executed inside the VM.
+type Hooks struct {
+	CreateContainer []Hook // after the mounts of the entrypoint
+	Poststart       []Hook // after the entrypoint has started
+	StartContainer  []Hook // before the entrypoint program is executed
+	State           []byte // OCI container state as JSON
+}
+
+// IOPriority defines the I/O scheduling class and priority.
+type IOPriority struct {
+	Class    string // IOPRIO_CLASS_RT, IOPRIO_CLASS_BE or IOPRIO_CLASS_IDLE
+	Priority int
+}
+
+// Personality defines the execution domain.
+type Personality struct {
+	Domain string // LINUX or LINUX32
+	Flags  []string
+}
+
+// Scheduler defines the scheduling policy and attributes.
+type Scheduler struct {
+	Deadline uint64
+	Flags    []string
+	Nice     int32
+	Period   uint64
+	Policy   string // e.g. SCHED_OTHER, SCHED_FIFO
+	Priority int32
+	Runtime  uint64
+}
+
+// TimeOffset defines the offset of a clock in a time namespace.
+type TimeOffset struct {
+	Secs     int64
+	Nanosecs uint32
+}
+
+// Resources contains the resource limits of the entrypoint cgroup.
+type Resources struct {
+	CPUPeriod   uint64
+	CPUQuota    int64
+	CPUShares   uint64
+	Devices     []DeviceRule
+	MemoryLimit int64 // bytes
+	PidsLimit   int64
+}
+
+// DeviceRule defines a device cgroup rule.
+type DeviceRule struct {
+	Access string // combination of r, w and m
+	Allow  bool
+	Major  int64  // -1 for all
+	Minor  int64  // -1 for all
+	Type   string // a, b or c
+}
+
+// SeccompAgent defines the seccomp agent on the host that receives the
+// user notifications of the entrypoint.
+type SeccompAgent struct {
+	Metadata string
+	State    []byte // OCI container state as JSON
+}
+
 // Certificates definenes TLS certificates
 type Certificates struct {
 	CACert []byte
@@ -105,15 +234,31 @@ type Entrypoint struct {
 	User
 	Args            []string
 	Capabilities    AppCapabilities
+	Cgroup          string // cgroup version v1 or v2
 	Cwd             string
+	Devices         []Device
 	DockerInit      string
+	Domainname      string
 	Env             []string
+	GIDMappings     []IDMap
+	Hooks           Hooks
+	Hostname        string
+	IOPriority      *IOPriority
+	MaskedPaths     []string
+	Namespaces      []string // additional namespaces: cgroup, time, uts
 	NoNewPrivileges bool
+	OOMScoreAdj     *int
+	Personality     *Personality
+	ReadonlyPaths   []string
+	Resources       Resources
 	Rlimits         map[string]syscall.Rlimit
 	Runqenv         bool
+	Scheduler       *Scheduler
 	SeccompGob      []byte
 	Systemd         bool
 	Terminal        bool
+	TimeOffsets     map[string]TimeOffset
+	UIDMappings     []IDMap
 }
 
 // Vsockd contains config data for the vsockd process.
@@ -122,6 +267,7 @@ type Vsockd struct {
 	EntrypointPid int
 	EntrypointEnv []string
 	CID           uint32
+	Disks         []DiskInfo
 }
 
 // DNS contains dns configuration.
@@ -150,9 +296,26 @@ type Data struct {
 	Networks        []Network
 	NoExec          bool
 	QemuVersion     string
+	ReadonlyRootfs  bool
+	ReadonlyVolumes []string // destinations of read-only bind mounts
 	Rootdisk        string
+	RootdiskDir     string
+	RootdiskDryRun  bool
 	RootdiskExclude []string
+	RootdiskFormat  string
+	RootdiskFstype  string
+	RootdiskSize    int64
+	RootdiskSync    string
+	RootfsOverlay   string // tmpfs or disk ID of the upper layer
+	RootfsPmem      string // erofs or squashfs image of the rootfs layers
+	RootfsWriteback bool
+	SeccompAgent    *SeccompAgent // nil without listener path
+	Share           string        // 9p (default) or virtiofs
+	Shares9p        []Share9p
 	Sysctl          map[string]string
+	VirtiofsDAX     bool
+	Volumes         []string // destinations of bind mounts
+	Zram            int64    // size of zram swap device in bytes
 	Entrypoint      Entrypoint
 	Vsockd          Vsockd
 }
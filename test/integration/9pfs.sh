@@ -22,4 +22,52 @@ docker run \
 
 checkrc $? 0 "$comment"
 
+comment="9p share per volume with own cache mode"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -v /tmp:/data \
+    -e RUNQ_9PSHARES=/data:fscache \
+    $image  \
+    sh -c "grep '^vol0 /data 9p [^ ]*,fscache[, ]' /proc/mounts"
+
+checkrc $? 0 "$comment"
+
+# The kernel doesn't list cache mode none in the mount options.
+comment="9p share per volume with cache mode none"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -v /tmp:/data \
+    -e RUNQ_9PSHARES=/data:none \
+    $image  \
+    sh -c "grep '^vol0 /data 9p ' /proc/mounts && ! grep -E '^vol0 /data 9p [^ ]*,(loose|fscache|mmap)[, ]' /proc/mounts"
+
+checkrc $? 0 "$comment"
+
+comment="read-only 9p share per volume"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -v /tmp:/data:ro \
+    -e RUNQ_9PSHARES=/data:loose \
+    $image  \
+    sh -c "grep '^vol0 /data 9p ro,[^ ]*,loose[, ]' /proc/mounts"
+
+checkrc $? 0 "$comment"
+
+comment="9p share for unknown volume"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_9PSHARES=/data \
+    $image  \
+    true
+
+checkrc $? 1 "$comment"
+
 myexit
@@ -119,3 +119,44 @@ comment="runc and runq drop same capabilities"
 diff $tmpfileA $tmpfileB
 checkrc $? 0 "$comment"
 
+
+#
+#
+#
+chmod 0666 $tmpfileA $tmpfileB
+comment="capture capabilities of non-root user from runc"
+docker run \
+    --runtime runc \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_CPU=2 \
+    -v $tmpfileA:/results \
+    --user 1000:1000 \
+    --cap-add net_bind_service \
+    $image \
+    sh -c 'grep ^Cap /proc/$$/status >/results'
+
+checkrc $? 0 "$comment"
+
+#
+#
+comment="capture capabilities of non-root user from runq"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_CPU=2 \
+    -v $tmpfileB:/results \
+    --user 1000:1000 \
+    --cap-add net_bind_service \
+    $image \
+    sh -c 'grep ^Cap /proc/$$/status >/results'
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="runc and runq set same capabilities for non-root user"
+diff $tmpfileA $tmpfileB
+checkrc $? 0 "$comment"
@@ -0,0 +1,47 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+comment="cgroup v1 by default"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    $image  \
+    sh -c "grep -q '^cgroup /sys/fs/cgroup/memory cgroup' /proc/mounts"
+
+checkrc $? 0 "$comment"
+
+comment="cgroup v2"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_CGROUP=v2 \
+    $image  \
+    sh -c "grep -q '^cgroup2 /sys/fs/cgroup cgroup2' /proc/mounts && grep -qw memory /sys/fs/cgroup/cgroup.controllers"
+
+checkrc $? 0 "$comment"
+
+comment="cgroup v2 entrypoint in root of cgroup namespace"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_CGROUP=v2 \
+    $image  \
+    sh -c "test \"\$(cat /proc/self/cgroup)\" = '0::/'"
+
+checkrc $? 0 "$comment"
+
+comment="invalid cgroup version"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_CGROUP=v3 \
+    $image  \
+    true
+
+checkrc $? 1 "$comment"
+
+myexit
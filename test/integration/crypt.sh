@@ -0,0 +1,79 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+command -v cryptsetup >/dev/null || skip "reason: cryptsetup not found"
+
+set -u
+
+dev=/tmp/file-$$
+key=/tmp/key-$$
+mnt=/mnt
+
+cleanup() {
+    rm -f $dev $key
+}
+
+trap "cleanup; myexit" EXIT
+
+echo -n secret-$$ > $key
+
+for type in luks1 luks2; do
+    dd if=/dev/zero of=$dev bs=1M count=100 >/dev/null
+    cryptsetup luksFormat --batch-mode --type $type --pbkdf pbkdf2 --key-file $key $dev
+    loop=$(losetup --find --show $dev)
+    cryptsetup open --key-file $key $loop crypt-$$
+    mkfs.ext4 -q /dev/mapper/crypt-$$
+    cryptsetup close crypt-$$
+    losetup -d $loop
+
+    comment="mount $type encrypted disk"
+    cmd="df -T | awk '/\/dev\/dm-/{ print \$2 }' | grep -w ext4"
+
+    docker run \
+        --runtime runq \
+        --name $(rand_name) \
+        --rm \
+        --annotation runq.disk.0001.crypt=luks \
+        --annotation runq.disk.0001.key=$key \
+        -v $dev:/dev/runq/0001/writeback/ext4/$mnt \
+        $image \
+        sh -c "$cmd"
+
+    checkrc $? 0 "$comment"
+done
+
+#
+#
+#
+comment="wrong passphrase"
+echo -n wrong > $key
+
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --annotation runq.disk.0001.crypt=luks \
+    --annotation runq.disk.0001.key=$key \
+    -v $dev:/dev/runq/0001/writeback/ext4/$mnt \
+    $image \
+    true
+
+checkrc $? 1 "$comment"
+
+#
+#
+#
+comment="key is not visible in the container"
+echo -n secret-$$ > $key
+
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --annotation runq.disk.0001.crypt=luks \
+    --annotation runq.disk.0001.key=$key \
+    -v $dev:/dev/runq/0001/writeback/ext4/$mnt \
+    $image \
+    sh -c "! grep -rqs secret-$$ /dev /proc/cmdline"
+
+checkrc $? 0 "$comment"
@@ -0,0 +1,55 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+comment="character device of the host"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --device /dev/fuse \
+    $image  \
+    sh -c 'test -c /dev/fuse && exec 3<>/dev/fuse'
+
+checkrc $? 0 "$comment"
+
+comment="owner and mode of a character device"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --device /dev/net/tun \
+    $image  \
+    sh -c 'test -c /dev/net/tun && test "$(stat -c %a:%u:%g /dev/net/tun)" = "666:0:0"'
+
+checkrc $? 0 "$comment"
+
+comment="device not allowed by device cgroup rules"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    $image  \
+    sh -c 'mknod /dev/fuse2 c 10 229 && ! (exec 3<>/dev/fuse2) 2>/dev/null'
+
+checkrc $? 0 "$comment"
+
+comment="device not provided by the guest kernel"
+if [ $(id -u) -eq 0 ]; then
+    tmpdir=$(mktemp -d)
+    # Major 60 is reserved for local use and not assigned by the guest kernel.
+    mknod $tmpdir/unknown c 60 7
+    docker run \
+        --runtime runq \
+        --name $(rand_name) \
+        --rm \
+        --device $tmpdir/unknown:/dev/unknown \
+        $image  \
+        true
+    test $? -ne 0
+    checkrc $? 0 "$comment"
+    rm -rf $tmpdir
+else
+    skip_msg "$comment" "reason: requires root"
+fi
+
+myexit
@@ -0,0 +1,46 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+set -u
+
+dev=/tmp/file-$$
+name=$(rand_name)
+
+cleanup() {
+    docker rm -f $name &>/dev/null
+    rm -f $dev
+}
+
+trap "cleanup; myexit" EXIT
+
+dd if=/dev/zero of=$dev bs=1M count=100 >/dev/null
+mkfs.ext4 -q -F $dev
+
+docker run \
+    --runtime runq \
+    --name $name \
+    -v $dev:/dev/runq/0001/none/ext4/data \
+    -dt \
+    $image sh
+
+sleep 2
+
+$runq_exec $name sh -c "dd if=/dev/zero of=/data/foo bs=1M count=10 && sync"
+
+comment="disk stats of mounted disk"
+stats=$($runq_exec --disk-stats $name)
+checkrc $? 0 "$comment"
+
+comment="disk stats contain disk id and mount point"
+echo "$stats" | grep -q '"id": "0001"' && echo "$stats" | grep -q '"mountpoint": "/data"'
+checkrc $? 0 "$comment"
+
+comment="disk stats contain filesystem usage"
+used=$(echo "$stats" | awk -F'[:,]' '/"used_bytes"/ {print $2}')
+test "$used" -ge $((10 << 20))
+checkrc $? 0 "$comment"
+
+comment="disk stats contain I/O counters"
+written=$(echo "$stats" | awk -F'[:,]' '/"write_bytes"/ {print $2}')
+test "$written" -ge $((10 << 20))
+checkrc $? 0 "$comment"
@@ -38,6 +38,35 @@ for fs in ext2 ext3 ext4 xfs; do
     checkrc $? 0 "$comment"
 done
 
+#
+#
+#
+for fs in ext4 xfs; do
+    rm -f $dev
+    case "$fs" in
+        ext4)
+            dd if=/dev/zero of=$dev bs=1M count=100 >/dev/null
+            mkfs.$fs -F $dev
+            ;;
+        xfs)
+            mkfs.xfs -dfile,name=$dev,size=100m
+            ;;
+    esac
+
+    comment="mount auto detected $fs"
+    cmd="df -T | awk '/\/dev\/vda/{ print \$2 }' | grep -w $fs"
+
+    docker run \
+        --runtime runq \
+        --name $(rand_name) \
+        --rm \
+        -v $dev:/dev/runq/$(uuid)/writeback/auto/$mnt \
+        $image \
+        sh -c "$cmd"
+
+    checkrc $? 0 "$comment"
+done
+
 #
 #
 #
@@ -0,0 +1,56 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+set -u
+
+dev=/tmp/file-$$
+name=$(rand_name)
+
+cleanup() {
+    docker rm -f $name &>/dev/null
+    rm -f $dev
+}
+
+trap "cleanup; myexit" EXIT
+
+dd if=/dev/zero of=$dev bs=1M count=100 >/dev/null
+mkfs.ext4 -q -F $dev
+
+docker run \
+    --runtime runq \
+    --name $name \
+    -v $dev:/dev/runq/$(uuid)/none/ext4/data \
+    -dt \
+    $image sh
+
+sleep 2
+
+comment="freeze disk filesystems"
+$runq_exec --freeze $name
+checkrc $? 0 "$comment"
+
+comment="freeze twice"
+$runq_exec --freeze $name
+checkrc $? 1 "$comment"
+
+comment="write blocks while frozen"
+timeout 3 $runq_exec $name sh -c "echo foo > /data/foo && sync"
+checkrc $? 124 "$comment"
+
+comment="thaw disk filesystems"
+$runq_exec --thaw $name
+checkrc $? 0 "$comment"
+
+comment="write after thaw"
+$runq_exec $name sh -c "echo foo > /data/foo && sync"
+checkrc $? 0 "$comment"
+
+comment="automatic thaw after timeout"
+$runq_exec --freeze --freeze-timeout 2s $name
+sleep 4
+timeout 3 $runq_exec $name sh -c "echo bar > /data/foo && sync"
+checkrc $? 0 "$comment"
+
+comment="freeze and thaw are exclusive"
+$runq_exec --freeze --thaw $name
+checkrc $? 1 "$comment"
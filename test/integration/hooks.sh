@@ -0,0 +1,51 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+if ! docker run --help | grep -q -- --annotation; then
+    skip "reason: docker run does not support annotations"
+fi
+
+comment="createContainer and startContainer hooks inside the VM"
+hooks='{
+  "createContainer":[{"path":"/bin/sh","args":["sh","-c","echo create > /tmp/hooks"]}],
+  "startContainer":[{"path":"/bin/sh","args":["sh","-c","grep -q created && echo start >> /tmp/hooks"]}]
+}'
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --annotation runq.hooks="$hooks" \
+    $image  \
+    sh -c 'test "$(cat /tmp/hooks)" = "$(printf "create\nstart")"'
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="poststart hook inside the VM"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --annotation runq.hooks='{"poststart":[{"path":"/bin/sh","args":["sh","-c","echo poststart > /tmp/poststart"]}]}' \
+    $image  \
+    sh -c 'sleep 2; grep -q poststart /tmp/poststart'
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="failing startContainer hook"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --annotation runq.hooks='{"startContainer":[{"path":"/bin/false"}]}' \
+    $image  \
+    true
+
+checkrc $? 1 "$comment"
+
+myexit
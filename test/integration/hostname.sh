@@ -12,4 +12,38 @@ docker run \
 
 checkrc $? 0 "$comment"
 
+#
+#
+#
+comment="set custom domainname"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --domainname example.com \
+    $image  \
+    sh -c 'grep -w example.com /proc/sys/kernel/domainname'
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="runq-exec joins the UTS namespace of the entrypoint"
+name=$(rand_name)
+docker run \
+    --runtime runq \
+    --name $name \
+    -d \
+    --cap-add sys_admin \
+    --hostname foobar \
+    $image  \
+    sh -c 'hostname changed; sleep 30'
+
+sleep 2
+$runq_exec $name hostname | grep -w changed
+checkrc $? 0 "$comment"
+
+docker rm -f $name >/dev/null
+
 myexit
@@ -40,4 +40,17 @@ docker run \
 
 checkrc $? 0 "$comment"
 
+#
+#
+#
+comment="private cgroup namespace"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --cgroupns private \
+    $image sh -c 'grep -v ":/$" /proc/self/cgroup; test $? -eq 1'
+
+checkrc $? 0 "$comment"
+
 myexit
@@ -0,0 +1,76 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+set -u
+
+dev=/tmp/file-$$
+name=$(rand_name)
+
+cleanup() {
+    docker rm -f $name 2>/dev/null
+    rm -f $dev
+}
+
+trap "cleanup; myexit" EXIT
+
+comment="rootfs overlay on tmpfs"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_ROOTFS_OVERLAY=tmpfs \
+    $image  \
+    sh -c "grep -q '^overlay / overlay' /proc/mounts && touch /foo"
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="rootfs overlay on scratch disk"
+dd if=/dev/zero of=$dev bs=1M count=100 >/dev/null
+mkfs.ext4 -q -F $dev
+
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -v $dev:/dev/runq/0001/writeback/ext4 \
+    -e RUNQ_ROOTFS_OVERLAY=0001 \
+    $image  \
+    sh -c "grep -q '^overlay / overlay' /proc/mounts && touch /foo"
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="changes are discarded without writeback"
+docker run \
+    --runtime runq \
+    --name $name \
+    -e RUNQ_ROOTFS_OVERLAY=tmpfs \
+    $image  \
+    sh -c "echo foobar > /etc/foo && rm /etc/passwd"
+
+docker cp $name:/etc/passwd - >/dev/null
+checkrc $? 0 "$comment"
+docker rm -f $name >/dev/null
+
+#
+#
+#
+comment="changes are written back"
+docker run \
+    --runtime runq \
+    --name $name \
+    -e RUNQ_ROOTFS_OVERLAY=tmpfs \
+    -e RUNQ_ROOTFS_WRITEBACK=1 \
+    $image  \
+    sh -c "echo foobar > /etc/foo && rm /etc/passwd"
+
+docker cp $name:/etc/foo - | grep -q foobar
+checkrc $? 0 "$comment"
+
+docker cp $name:/etc/passwd - >/dev/null 2>&1
+checkrc $? 1 "deleted files are removed"
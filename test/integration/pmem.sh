@@ -0,0 +1,40 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+[ "$(uname -m)" = "x86_64" ] || skip "reason: pmem is supported on x86_64 only"
+
+for fs in erofs squashfs; do
+    case $fs in
+        erofs) tool=mkfs.erofs ;;
+        squashfs) tool=mksquashfs ;;
+    esac
+    if ! which $tool >/dev/null; then
+        echo "$tool not found, skipping $fs"
+        continue
+    fi
+
+    comment="image layers via pmem ($fs)"
+    docker run \
+        --runtime runq \
+        --name $(rand_name) \
+        --rm \
+        -v /tmp:/data \
+        -e RUNQ_ROOTFS_PMEM=$fs \
+        $image  \
+        sh -c "grep -q pmem0 /proc/partitions && grep -q '^overlay / overlay' /proc/mounts && touch /foo && test -d /data/."
+
+    checkrc $? 0 "$comment"
+
+    comment="image layers via pmem ($fs) cached"
+    docker run \
+        --runtime runq \
+        --name $(rand_name) \
+        --rm \
+        -e RUNQ_ROOTFS_PMEM=$fs \
+        $image  \
+        sh -c "test -e /bin/sh"
+
+    checkrc $? 0 "$comment"
+done
+
+myexit
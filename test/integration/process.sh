@@ -0,0 +1,15 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+comment="oom score adjustment of the entrypoint"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --oom-score-adj 500 \
+    $image  \
+    sh -c 'test $(cat /proc/self/oom_score_adj) -eq 500'
+
+checkrc $? 0 "$comment"
+
+myexit
@@ -0,0 +1,40 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+comment="read-only rootfs"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --read-only \
+    $image  \
+    sh -c "! touch /foo"
+
+checkrc $? 0 "$comment"
+
+comment="tmpfs and volumes are writable with read-only rootfs"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --read-only \
+    --tmpfs /scratch \
+    -v /tmp:/data \
+    $image  \
+    sh -c "touch /scratch/foo /dev/shm/foo && f=/data/\$RANDOM && touch \$f && rm \$f"
+
+checkrc $? 0 "$comment"
+
+comment="read-only rootdisk"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --read-only \
+    -e RUNQ_ROOTDISK_SIZE=1G \
+    $image  \
+    sh -c "! touch /foo"
+
+checkrc $? 0 "$comment"
+
+myexit
@@ -0,0 +1,71 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+comment="pids limit cgroup v1"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --pids-limit 100 \
+    $image  \
+    sh -c "test \$(cat /sys/fs/cgroup/pids/container/pids.max) = 100"
+
+checkrc $? 0 "$comment"
+
+comment="pids limit cgroup v2"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --pids-limit 100 \
+    -e RUNQ_CGROUP=v2 \
+    $image  \
+    sh -c "test \$(cat /sys/fs/cgroup/pids.max) = 100"
+
+checkrc $? 0 "$comment"
+
+comment="memory limit capped by VM memory"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_CGROUP=v2 \
+    $image  \
+    sh -c "test \$(cat /sys/fs/cgroup/memory.max) -lt \$((\$(awk '/^MemTotal/{print \$2}' /proc/meminfo) * 1024))"
+
+checkrc $? 0 "$comment"
+
+comment="device not allowed cgroup v1"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    $image  \
+    sh -c "echo runq > /dev/kmsg"
+
+checkrc $? 1 "$comment"
+
+comment="device not allowed cgroup v2"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_CGROUP=v2 \
+    $image  \
+    sh -c "echo runq > /dev/kmsg"
+
+checkrc $? 1 "$comment"
+
+comment="device allowed by rule"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --device-cgroup-rule 'c 1:11 w' \
+    -e RUNQ_CGROUP=v2 \
+    $image  \
+    sh -c "echo runq > /dev/kmsg"
+
+checkrc $? 0 "$comment"
+
+myexit
@@ -0,0 +1,41 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+test -e /sys/block/nbd0 || skip "reason: kernel module nbd not loaded"
+
+name=$(rand_name)
+
+cleanup() {
+   docker rm -f $name 2>/dev/null
+   myexit
+}
+trap cleanup EXIT
+
+set -u
+
+docker run \
+    --runtime runq \
+    --name $name \
+    --init \
+    -e RUNQ_ROOTDISK_SIZE=1G \
+    -e RUNQ_ROOTDISK_FORMAT=qcow2 \
+    -e RUNQ_ROOTDISK_FSTYPE=xfs \
+    -d \
+    $image sleep 100
+
+sleep 2
+$runq_exec $name sh -c "grep '^/dev/vda / xfs' /proc/mounts"
+checkrc $? 0  "rootfs is on xfs block device"
+
+$runq_exec $name sh -c "echo foobar > /etc/passwd"
+checkrc $? 0 "update file"
+
+docker stop $name
+checkrc $? 0 "container has been stopped"
+
+docker start $name
+checkrc $? 0 "container has been re-started"
+sleep 2
+
+$runq_exec $name sh -c "grep foobar /etc/passwd"
+checkrc $? 0 "qcow2 rootdisk has been reused"
@@ -30,6 +30,9 @@ sleep 2
 $runq_exec $name sh -c "grep '^/dev/vda / ext4' /proc/mounts"
 checkrc $? 0  "rootfs is on block device"
 
+test -z "$(losetup -j $file)"
+checkrc $? 0 "loop device of the rootdisk has been released"
+
 $runq_exec $name sh -c "ls -d /media"
 checkrc $? 1 "directory has been excluded"
 
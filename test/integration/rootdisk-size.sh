@@ -0,0 +1,44 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+name=$(rand_name)
+vol=vol-$$
+
+cleanup() {
+   docker rm -f $name 2>/dev/null
+   docker volume rm $vol >/dev/null 2>&1
+   myexit
+}
+trap cleanup EXIT
+
+set -u
+
+docker run \
+    --runtime runq \
+    --name $name \
+    --init \
+    --volume $vol:/disks \
+    -e RUNQ_ROOTDISK_SIZE=256M \
+    -e RUNQ_ROOTDISK_DIR=/disks \
+    -d \
+    $image sleep 100
+
+sleep 2
+$runq_exec $name sh -c "grep '^/dev/vda / ext4' /proc/mounts"
+checkrc $? 0  "rootfs is on block device"
+
+$runq_exec $name sh -c "ls -d /disks/rootdisk.img"
+checkrc $? 1 "rootdisk directory has been excluded"
+
+$runq_exec $name sh -c "echo foobar > /etc/passwd"
+checkrc $? 0 "update file"
+
+docker stop $name
+checkrc $? 0 "container has been stopped"
+
+docker start $name
+checkrc $? 0 "container has been re-started"
+sleep 2
+
+$runq_exec $name sh -c "grep foobar /etc/passwd"
+checkrc $? 0 "rootdisk has been reused"
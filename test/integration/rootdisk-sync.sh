@@ -0,0 +1,54 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+name=$(rand_name)
+file=$PWD/file-$$
+tag=$name
+
+cleanup() {
+   docker rm -f $name 2>/dev/null
+   docker rmi -f $tag:1 $tag:2 >/dev/null 2>&1
+   rm -f $file
+   myexit
+}
+trap cleanup EXIT
+
+dd if=/dev/zero of=$file bs=1M count=100 >/dev/null
+mkfs.ext2 -F $file
+
+docker build -q -t $tag:1 - <<EOD
+FROM $image
+RUN mkdir /data && echo 1 > /data/a && echo 1 > /data/b && echo 1 > /data/c
+EOD
+
+docker build -q -t $tag:2 - <<EOD
+FROM $image
+RUN mkdir /data && echo 2 > /data/a && echo 2 > /data/b && echo 2 > /data/d
+EOD
+
+docker run \
+    --runtime runq \
+    --rm \
+    --name $name \
+    --volume $file:/dev/runq/0001/none/ext2 \
+    -e RUNQ_ROOTDISK=0001 \
+    -e RUNQ_ROOTDISK_SYNC=image \
+    $tag:1 sh -c "test -f /.runq/manifest && echo local > /data/b"
+
+checkrc $? 0 "manifest has been written"
+
+cmd="test \$(cat /data/a) = 2 \
+  && test \$(cat /data/b) = local \
+  && test ! -e /data/c \
+  && test \$(cat /data/d) = 2 \
+  && grep -q /data/b /.runq/sync.log"
+docker run \
+    --runtime runq \
+    --rm \
+    --name $name \
+    --volume $file:/dev/runq/0001/none/ext2 \
+    -e RUNQ_ROOTDISK=0001 \
+    -e RUNQ_ROOTDISK_SYNC=image \
+    $tag:2 sh -c "$cmd"
+
+checkrc $? 0 "rootdisk has been updated to the new image"
@@ -0,0 +1,53 @@
+#!/bin/bash
+DIR=$(cd ${0%/*};pwd;)
+. $DIR/../common.sh
+
+if ! docker info --format '{{json .SecurityOptions}}'| grep -q 'name=seccomp'; then
+    skip "reason: Docker daemon does not support seccomp profiles"
+fi
+command -v python3 >/dev/null || skip "reason: python3 not found"
+
+tmpdir=$(mktemp -d)
+sock=$tmpdir/agent.sock
+log=$tmpdir/agent.log
+profile=$tmpdir/profile.json
+
+python3 $DIR/../testdata/seccomp-agent.py $sock $log &
+agent=$!
+
+cleanup() {
+    kill $agent 2>/dev/null
+    rm -rf $tmpdir
+    myexit
+}
+trap cleanup EXIT
+
+sleep 1
+cat > $profile <<EOD
+{
+  "defaultAction": "SCMP_ACT_ALLOW",
+  "listenerPath": "$sock",
+  "listenerMetadata": "runq-test",
+  "syscalls": [{"names": ["mkdir", "mkdirat"], "action": "SCMP_ACT_NOTIFY"}]
+}
+EOD
+
+comment="seccomp agent answers notifications"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --security-opt seccomp=$profile \
+    $image \
+    sh -c 'mkdir /foo 2>&1 | grep -i "operation not permitted"'
+
+checkrc $? 0 "$comment"
+
+head -1 $log | grep -q '"version": 1'
+checkrc $? 0 "agent received protocol version"
+
+head -1 $log | grep -q '"metadata": "runq-test"'
+checkrc $? 0 "agent received listener metadata"
+
+grep -q '"syscall": "mkdir' $log
+checkrc $? 0 "agent received notification"
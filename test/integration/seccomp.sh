@@ -53,6 +53,45 @@ docker run \
 checkrc $? 0 "$comment"
 
 
+echo '{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["mkdir","mkdirat"],"action":"SCMP_ACT_ERRNO","errnoRet":13}]}' > $custom_profile
+comment="custom profile with errnoRet"
+docker run \
+    --runtime $runtime \
+    --name `rand_name` \
+    --rm \
+    --security-opt seccomp=$custom_profile \
+    $image \
+    sh -c 'mkdir /foo 2>&1 | grep -i "permission denied"'
+
+checkrc $? 0 "$comment"
+
+
+echo '{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["unshare"],"action":"SCMP_ACT_KILL_PROCESS"}]}' > $custom_profile
+comment="custom profile with SCMP_ACT_KILL_PROCESS"
+docker run \
+    --runtime $runtime \
+    --name `rand_name` \
+    --rm \
+    --security-opt seccomp=$custom_profile \
+    $image \
+    unshare true
+
+checkrc $? 159 "$comment"
+
+
+echo '{"defaultAction":"SCMP_ACT_LOG","flags":["SECCOMP_FILTER_FLAG_LOG"]}' > $custom_profile
+comment="custom profile with SCMP_ACT_LOG"
+docker run \
+    --runtime $runtime \
+    --name `rand_name` \
+    --rm \
+    --security-opt seccomp=$custom_profile \
+    $image \
+    true
+
+checkrc $? 0 "$comment"
+
+
 comment="seccomp=unconfined allows unshare"
 docker run \
     --runtime $runtime \
@@ -0,0 +1,74 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+set -u
+
+dev=/tmp/file-$$
+
+cleanup() {
+    rm -f $dev
+}
+
+trap "cleanup; myexit" EXIT
+
+dd if=/dev/zero of=$dev bs=1M count=100 >/dev/null
+
+comment="swap disk"
+cmd="grep -q '^/dev/vda' /proc/swaps"
+
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -v $dev:/dev/runq/$(uuid)/writeback/swap \
+    $image \
+    sh -c "$cmd"
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="reuse swap disk"
+
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -v $dev:/dev/runq/$(uuid)/writeback/swap \
+    $image \
+    sh -c "$cmd"
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="reject disk with filesystem as swap"
+mkfs.ext4 -q -F $dev
+
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -v $dev:/dev/runq/$(uuid)/writeback/swap \
+    $image \
+    true
+
+checkrc $? 1 "$comment"
+
+#
+#
+#
+comment="zram swap"
+cmd="grep -q '^/dev/zram0' /proc/swaps"
+
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_ZRAM=64M \
+    $image \
+    sh -c "$cmd"
+
+checkrc $? 0 "$comment"
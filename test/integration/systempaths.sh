@@ -0,0 +1,41 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+comment="masked paths"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    $image  \
+    sh -c 'test ! -s /proc/kcore && grep -w /proc/kcore /proc/self/mountinfo'
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="read-only paths"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    $image  \
+    sh -c 'grep -w /proc/sysrq-trigger /proc/self/mountinfo | grep -w ro'
+
+checkrc $? 0 "$comment"
+
+#
+#
+#
+comment="unconfined system paths"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    --security-opt systempaths=unconfined \
+    $image  \
+    sh -c '! grep -w -e /proc/kcore -e /proc/sysrq-trigger /proc/self/mountinfo'
+
+checkrc $? 0 "$comment"
+
+myexit
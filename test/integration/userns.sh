@@ -0,0 +1,50 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+docker info --format '{{.SecurityOptions}}' | grep -q userns || skip "reason: docker daemon runs without --userns-remap"
+
+tmpdir=$(mktemp -d)
+chmod 0777 $tmpdir
+name=$(rand_name)
+
+cleanup() {
+    rm -rf $tmpdir
+    docker rm -f $name &>/dev/null
+}
+trap "cleanup; myexit" EXIT
+
+comment="entrypoint runs in user namespace"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    $image  \
+    sh -c "awk '{exit \$2 == 0}' /proc/self/uid_map"
+
+checkrc $? 0 "$comment"
+
+comment="files on volume are created with mapped ids"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -v $tmpdir:/data \
+    $image  \
+    sh -c "touch /data/file && test \$(stat -c %u /data/file) -eq 0"
+
+checkrc $? 0 "$comment"
+
+test "$(stat -c %u $tmpdir/file)" -ne 0
+checkrc $? 0 "$comment (host)"
+
+comment="runq-exec runs in user namespace"
+docker run \
+    --runtime runq \
+    --name $name \
+    -dt \
+    $image sh
+
+sleep 2
+
+$runq_exec $name sh -c "awk '{exit \$2 == 0}' /proc/self/uid_map && test \$(id -u) -eq 0"
+checkrc $? 0 "$comment"
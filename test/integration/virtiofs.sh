@@ -0,0 +1,28 @@
+#!/bin/bash
+. $(cd ${0%/*};pwd;)/../common.sh
+
+[ "$(uname -m)" = "x86_64" ] || skip "reason: virtiofs is supported on x86_64 only"
+
+comment="rootfs shared via virtiofs"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_SHARE=virtiofs \
+    $image  \
+    sh -c "grep '^rootfs / virtiofs' /proc/mounts && touch /foo && rm /foo"
+
+checkrc $? 0 "$comment"
+
+comment="invalid share type"
+docker run \
+    --runtime runq \
+    --name $(rand_name) \
+    --rm \
+    -e RUNQ_SHARE=nfs \
+    $image  \
+    true
+
+checkrc $? 1 "$comment"
+
+myexit
@@ -0,0 +1,43 @@
+#!/usr/bin/env python3
+"""Minimal seccomp agent for runq, see README section Seccomp.
+
+Usage: seccomp-agent.py <socket> <log file>
+
+Every notification is answered with EPERM. All received lines are written
+to the log file.
+"""
+import json
+import os
+import socket
+import sys
+
+EPERM = 1
+VERSION = 1
+
+
+def main():
+    path, logfile = sys.argv[1], sys.argv[2]
+    if os.path.exists(path):
+        os.unlink(path)
+    srv = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    srv.bind(path)
+    srv.listen(1)
+    while True:
+        conn, _ = srv.accept()
+        with conn, conn.makefile("rw") as f, open(logfile, "a") as log:
+            hello = json.loads(f.readline())
+            log.write(json.dumps(hello) + "\n")
+            log.flush()
+            if hello.get("version") != VERSION:
+                continue
+            for line in f:
+                notif = json.loads(line)
+                log.write(json.dumps(notif) + "\n")
+                log.flush()
+                resp = {"id": notif["id"], "val": 0, "error": -EPERM, "flags": 0}
+                f.write(json.dumps(resp) + "\n")
+                f.flush()
+
+
+if __name__ == "__main__":
+    main()